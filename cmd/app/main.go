@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -11,8 +13,13 @@ import (
 
 	"github.com/szykes/simple-backend/config"
 	"github.com/szykes/simple-backend/controllers"
+	"github.com/szykes/simple-backend/mailer"
 	"github.com/szykes/simple-backend/migrations"
 	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/oidc"
+	"github.com/szykes/simple-backend/password"
+	"github.com/szykes/simple-backend/ratelimit"
+	"github.com/szykes/simple-backend/storage"
 	"github.com/szykes/simple-backend/templates"
 	"github.com/szykes/simple-backend/views"
 )
@@ -36,53 +43,268 @@ func main() {
 	}
 
 	// setup services
+	var hasher password.Hasher
+	switch cfg.Password.Hasher {
+	case "bcrypt":
+		hasher = &password.Bcrypt{
+			Cost: cfg.Password.Bcrypt.Cost,
+		}
+	case "argon2id":
+		hasher = &password.Argon2id{
+			Time:    uint32(cfg.Password.Argon2.Time),
+			Memory:  uint32(cfg.Password.Argon2.Memory),
+			Threads: uint8(cfg.Password.Argon2.Threads),
+		}
+	default:
+		panic("unknown password hasher: " + cfg.Password.Hasher)
+	}
+
+	passwordPolicy := password.Policy{
+		MinLength: cfg.Password.MinLength,
+		MaxLength: cfg.Password.MaxLength,
+	}
+	if cfg.Password.BreachedDir != "" {
+		passwordPolicy.Breached = &password.BreachedDir{
+			Dir: cfg.Password.BreachedDir,
+		}
+	}
+
+	registrationPolicy := models.RegistrationPolicy{
+		Mode:           cfg.Registration.Mode,
+		AllowedDomains: cfg.Registration.AllowedDomains,
+	}
+
 	userService := models.UserService{
-		DB: db,
+		DB:           db,
+		Hasher:       hasher,
+		Policy:       &passwordPolicy,
+		Registration: &registrationPolicy,
 	}
 	sessionService := models.SessionService{
-		DB: db,
+		DB:                  db,
+		Lifetime:            cfg.Session.Lifetime,
+		IdleTimeout:         cfg.Session.IdleTimeout,
+		RememberLifetime:    cfg.Session.RememberLifetime,
+		RememberIdleTimeout: cfg.Session.RememberIdleTimeout,
 	}
 	passwordResetService := models.PasswordResetService{
 		DB: db,
 	}
+	signInLinkService := models.SignInLinkService{
+		DB: db,
+	}
+	emailVerificationService := models.EmailVerificationService{
+		DB: db,
+	}
+	emailChangeService := models.EmailChangeService{
+		DB: db,
+	}
+	twoFactorService := models.TwoFactorService{
+		DB:     db,
+		Issuer: cfg.TOTP.Issuer,
+	}
+	attemptService := models.AttemptService{
+		DB:               db,
+		MaxFailures:      cfg.Attempts.MaxFailures,
+		MaxFailuresPerIP: cfg.Attempts.MaxFailuresPerIP,
+		Lockout:          cfg.Attempts.Lockout,
+		MaxLockout:       cfg.Attempts.MaxLockout,
+		Window:           cfg.Attempts.Window,
+	}
+	imageStorage, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+
 	galleryService := models.GalleryService{
+		DB:      db,
+		Storage: imageStorage,
+		Limits:  cfg.Uploads,
+	}
+	identityService := models.IdentityService{
+		DB:           db,
+		Registration: &registrationPolicy,
+	}
+	invitationService := models.InvitationService{
+		DB: db,
+	}
+	dataExportService := models.DataExportService{
+		DB:             db,
+		GalleryService: &galleryService,
+		Dir:            cfg.Account.ExportDir,
+	}
+	accessTokenService := models.AccessTokenService{
 		DB: db,
 	}
+	auditService := models.AuditService{
+		DB: db,
+	}
+	accountDeletionService := models.AccountDeletionService{
+		DB:             db,
+		GalleryService: &galleryService,
+		GracePeriod:    cfg.Account.DeletionGracePeriod,
+	}
+
+	var mail mailer.Mailer
+	if cfg.Mail.SMTP.Host != "" {
+		mail = &mailer.SMTP{
+			Host:     cfg.Mail.SMTP.Host,
+			Port:     cfg.Mail.SMTP.Port,
+			Username: cfg.Mail.SMTP.Username,
+			Password: cfg.Mail.SMTP.Password,
+		}
+	} else {
+		mail, err = mailer.NewOutbox(cfg.Mail.Outbox)
+		if err != nil {
+			panic(err)
+		}
+	}
+	emailService := mailer.Service{
+		Mailer:    mail,
+		Templates: mailer.MustParseFS(templates.FS, "email"),
+		From:      cfg.Mail.From,
+		BaseURL:   cfg.Server.BaseURL,
+	}
+
+	// setup background jobs
+	go runPeriodically(time.Hour, "delete expired sessions", sessionService.DeleteExpired)
+	go runPeriodically(time.Hour, "delete expired 2fa challenges", twoFactorService.DeleteExpiredChallenges)
+	go runPeriodically(time.Hour, "delete stale auth attempts", attemptService.DeleteStale)
+	go runPeriodically(time.Hour, "purge deleted accounts", accountDeletionService.Purge)
+	go runPeriodically(time.Minute, "build data exports", func(ctx context.Context) error {
+		return dataExportService.BuildPending(ctx, emailService.DataExportReady)
+	})
+	go runPeriodically(time.Hour, "delete expired data exports", dataExportService.DeleteExpired)
+	go runPeriodically(time.Hour, "delete expired access tokens", accessTokenService.DeleteExpired)
+	go galleryService.RunRenditions(context.Background())
 
 	// setup middleware
 	userMw := controllers.UserMiddleware{
-		SessionService: &sessionService,
+		SessionService:     &sessionService,
+		AccessTokenService: &accessTokenService,
+	}
+
+	var rateLimitStore ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "memory":
+		rateLimitStore = ratelimit.NewMemoryStore()
+	case "postgres":
+		postgresStore := &ratelimit.PostgresStore{
+			DB: db,
+		}
+		go runPeriodically(time.Hour, "delete idle rate limit buckets", func(ctx context.Context) error {
+			return postgresStore.DeleteIdle(ctx, 24*time.Hour)
+		})
+		rateLimitStore = postgresStore
+	default:
+		panic("unknown rate limit store: " + cfg.RateLimit.Store)
+	}
+
+	authLimiter := ratelimit.Limiter{
+		Name:  "auth",
+		Store: rateLimitStore,
+		Limit: ratelimit.Limit{Requests: cfg.RateLimit.AuthPerMinute, Per: time.Minute},
+		Key:   ratelimit.ByIP,
+	}
+	galleryLimiter := ratelimit.Limiter{
+		Name:  "galleries",
+		Store: rateLimitStore,
+		Limit: ratelimit.Limit{Requests: cfg.RateLimit.GalleriesPerHour, Per: time.Hour},
+		Key:   ratelimit.ByUser,
+	}
+	uploadLimiter := ratelimit.Limiter{
+		Name:  "uploads",
+		Store: rateLimitStore,
+		Limit: ratelimit.Limit{Requests: cfg.RateLimit.UploadsPerMinute, Per: time.Minute},
+		Key:   ratelimit.ByUser,
 	}
 
 	csrfMw := csrf.Protect([]byte(cfg.CSRF.Key), csrf.Path("/"), csrf.Secure(cfg.CSRF.Secure))
 
 	// setup contollers
 	users := controllers.Users{
-		UserService:          &userService,
-		SessionService:       &sessionService,
-		PasswordResetService: &passwordResetService,
+		UserService:              &userService,
+		SessionService:           &sessionService,
+		PasswordResetService:     &passwordResetService,
+		SignInLinkService:        &signInLinkService,
+		EmailVerificationService: &emailVerificationService,
+		EmailChangeService:       &emailChangeService,
+		TwoFactorService:         &twoFactorService,
+		AttemptService:           &attemptService,
+		AccountDeletionService:   &accountDeletionService,
+		DataExportService:        &dataExportService,
+		IdentityService:          &identityService,
+		AuditService:             &auditService,
+		AccessTokenService:       &accessTokenService,
+		InvitationService:        &invitationService,
+		EmailService:             &emailService,
+	}
+	for _, provider := range cfg.OIDC {
+		users.OIDCProviders = append(users.OIDCProviders, &oidc.Provider{
+			Name:         provider.Name,
+			DisplayName:  provider.DisplayName,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  strings.TrimSuffix(cfg.Server.BaseURL, "/") + "/oauth/" + provider.Name + "/callback",
+		})
 	}
 	users.Templates.New = views.MustParseFS(templates.FS, "base.html", "signup.html")
 	users.Templates.SignIn = views.MustParseFS(templates.FS, "base.html", "signin.html")
 	users.Templates.ForgotPassword = views.MustParseFS(templates.FS, "base.html", "forgot-password.html")
 	users.Templates.CheckYourEmail = views.MustParseFS(templates.FS, "base.html", "check-your-email.html")
 	users.Templates.ResetPassword = views.MustParseFS(templates.FS, "base.html", "reset-password.html")
+	users.Templates.VerifyEmail = views.MustParseFS(templates.FS, "base.html", "verify-email.html")
+	users.Templates.Sessions = views.MustParseFS(templates.FS, "base.html", "sessions.html")
+	users.Templates.TwoFactor = views.MustParseFS(templates.FS, "base.html", "two-factor.html")
+	users.Templates.TwoFactorCode = views.MustParseFS(templates.FS, "base.html", "two-factor-code.html")
+	users.Templates.Account = views.MustParseFS(templates.FS, "base.html", "account.html")
+	users.Templates.ConfirmEmail = views.MustParseFS(templates.FS, "base.html", "confirm-email.html")
+	users.Templates.AccountDeleted = views.MustParseFS(templates.FS, "base.html", "account-deleted.html")
+	users.Templates.SignInLink = views.MustParseFS(templates.FS, "base.html", "signin-link.html")
+	users.Templates.Activity = views.MustParseFS(templates.FS, "base.html", "activity.html")
+	users.Templates.AccessTokens = views.MustParseFS(templates.FS, "base.html", "access-tokens.html")
+	users.Templates.Invitations = views.MustParseFS(templates.FS, "base.html", "invitations.html")
 
 	galleries := controllers.Galleries{
 		GalleryService: &galleryService,
+		AuditService:   &auditService,
 	}
 	galleries.Templates.New = views.MustParseFS(templates.FS, "base.html", "galleries_new.html")
 	galleries.Templates.Edit = views.MustParseFS(templates.FS, "base.html", "galleries_edit.html")
 	galleries.Templates.Index = views.MustParseFS(templates.FS, "base.html", "galleries_index.html")
 	galleries.Templates.Show = views.MustParseFS(templates.FS, "base.html", "galleries_show.html")
 
+	admin := controllers.Admin{
+		UserService:          &userService,
+		SessionService:       &sessionService,
+		PasswordResetService: &passwordResetService,
+		GalleryService:       &galleryService,
+		EmailService:         &emailService,
+		AuditService:         &auditService,
+	}
+	admin.Templates.Users = views.MustParseFS(templates.FS, "base.html", "admin_users.html")
+	admin.Templates.User = views.MustParseFS(templates.FS, "base.html", "admin_user.html")
+	admin.Templates.Audit = views.MustParseFS(templates.FS, "base.html", "admin_audit.html")
+
+	api := controllers.API{
+		GalleryService: &galleryService,
+		AuditService:   &auditService,
+	}
+	// Note: the API shares the buckets with the web pages, only the response differs.
+	apiGalleryLimiter := galleryLimiter
+	apiGalleryLimiter.Reject = api.RateLimited
+	apiUploadLimiter := uploadLimiter
+	apiUploadLimiter.Reject = api.RateLimited
+
 	// setup router
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 	r.Use(middleware.Timeout(10 * time.Second))
-	r.Use(csrfMw)
+	// Note: the user is set first, so the requests with access tokens can skip the CSRF check.
 	r.Use(userMw.SetUser)
+	r.Use(csrfMw)
 
 	t := views.MustParseFS(templates.FS, "base.html", "home.html")
 	r.Get("/", controllers.StaticHandler(t))
@@ -94,33 +316,111 @@ func main() {
 	r.Get("/faq", controllers.FAQ(t))
 
 	r.Get("/signup", users.New)
-	r.Post("/users", users.Create)
+	r.With(authLimiter.Handler).Post("/users", users.Create)
 	r.Get("/signin", users.SignIn)
-	r.Post("/signin", users.DoSignIn)
+	r.With(authLimiter.Handler).Post("/signin", users.DoSignIn)
+	r.Get("/signin/2fa", users.TwoFactorCode)
+	r.With(authLimiter.Handler).Post("/signin/2fa", users.DoTwoFactorCode)
+	r.Get("/signin/link", users.SignInLink)
+	r.With(authLimiter.Handler).Post("/signin/link", users.DoSignInLink)
+	r.With(authLimiter.Handler).Post("/signin/link/consume", users.ConsumeSignInLink)
 	r.Post("/signout", users.DoSignOut)
 	r.Get("/forgot-password", users.ForgetPassword)
-	r.Post("/forgot-password", users.DoForgetPassword)
+	r.With(authLimiter.Handler).Post("/forgot-password", users.DoForgetPassword)
 	r.Get("/reset-password", users.ResetPassword)
-	r.Post("/reset-password", users.DoResetPassword)
+	r.With(authLimiter.Handler).Post("/reset-password", users.DoResetPassword)
+	r.Get("/verify-email", users.VerifyEmail)
+	r.With(userMw.RequireUser).Post("/verify-email", users.ResendVerification)
+	r.Get("/confirm-email", users.ConfirmEmail)
+	r.With(authLimiter.Handler, userMw.DenyImpersonation).Post("/oauth/{provider}", users.StartOIDC)
+	r.With(authLimiter.Handler, userMw.DenyImpersonation).Get("/oauth/{provider}/callback", users.OIDCCallback)
 
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(userMw.RequireUser)
-		r.Get("/", users.CurrentUser)
+		r.Get("/", users.Account)
+		r.Post("/name", users.UpdateName)
+		r.With(userMw.DenyImpersonation, authLimiter.Handler).Post("/email", users.UpdateEmail)
+		r.With(userMw.DenyImpersonation).Post("/email/cancel", users.CancelEmailChange)
+		r.With(userMw.DenyImpersonation, authLimiter.Handler).Post("/password", users.UpdatePassword)
+		r.With(userMw.DenyImpersonation, authLimiter.Handler).Post("/delete", users.DeleteAccount)
+		r.With(userMw.DenyImpersonation).Post("/export", users.RequestDataExport)
+		r.With(userMw.DenyImpersonation).Get("/export/download", users.DownloadDataExport)
+		r.With(userMw.DenyImpersonation).Post("/identities/{id}/delete", users.UnlinkIdentity)
+		r.Get("/sessions", users.Sessions)
+		r.Get("/activity", users.Activity)
+		r.With(userMw.DenyImpersonation).Get("/tokens", users.AccessTokens)
+		r.With(userMw.DenyImpersonation).Post("/tokens", users.CreateAccessToken)
+		r.With(userMw.DenyImpersonation).Post("/tokens/{id}/delete", users.RevokeAccessToken)
+		r.With(userMw.RequireVerifiedUser).Get("/invitations", users.Invitations)
+		r.With(userMw.RequireVerifiedUser, userMw.DenyImpersonation).Post("/invitations", users.CreateInvitation)
+		r.With(userMw.DenyImpersonation).Post("/invitations/{id}/delete", users.RevokeInvitation)
+		r.Post("/sessions/delete-others", users.DeleteOtherSessions)
+		r.Post("/sessions/{id}/delete", users.DeleteSession)
+		r.Group(func(r chi.Router) {
+			r.Use(userMw.DenyImpersonation)
+			r.Get("/2fa", users.TwoFactor)
+			r.Post("/2fa/enroll", users.EnrollTwoFactor)
+			r.Post("/2fa/enable", users.EnableTwoFactor)
+			r.Post("/2fa/disable", users.DisableTwoFactor)
+		})
 	})
 
+	r.With(userMw.RequireUser).Post("/impersonation/stop", admin.StopImpersonation)
+
 	r.Route("/galleries", func(r chi.Router) {
-		r.Get("/{id}", galleries.Show)
-		r.Get("/{id}/images/{filename}", galleries.Image)
 		r.Group(func(r chi.Router) {
+			r.Use(userMw.RequireScope(models.ScopeGalleriesRead))
+			r.Get("/{id}", galleries.Show)
+			r.Get("/{id}/images/{filename}", galleries.Image)
+			r.With(userMw.RequireUser).Get("/", galleries.Index)
+			r.With(userMw.RequireUser).Get("/{id}/edit", galleries.Edit)
+		})
+		r.With(userMw.RequireVerifiedUser).Get("/new", galleries.New)
+		r.Group(func(r chi.Router) {
+			r.Use(userMw.RequireScope(models.ScopeGalleriesWrite))
 			r.Use(userMw.RequireUser)
-			r.Get("/", galleries.Index)
-			r.Get("/new", galleries.New)
-			r.Post("/", galleries.Create)
-			r.Get("/{id}/edit", galleries.Edit)
+			r.With(userMw.RequireVerifiedUser, galleryLimiter.Handler).Post("/", galleries.Create)
 			r.Post("/{id}", galleries.Update)
 			r.Post("/{id}/delete", galleries.Delete)
 			r.Post("/{id}/images/{filename}/delete", galleries.DeleteImage)
-			r.Post("/{id}/images", galleries.UploadImage)
+			r.With(uploadLimiter.Handler).Post("/{id}/images", galleries.UploadImage)
+		})
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(userMw.RequireRole(models.RoleAdmin))
+		r.Get("/users", admin.Users)
+		r.Get("/users/{id}", admin.User)
+		r.Get("/audit", admin.Audit)
+		r.Post("/users/{id}/disable", admin.DisableUser)
+		r.Post("/users/{id}/enable", admin.EnableUser)
+		r.Post("/users/{id}/signout", admin.SignOutUser)
+		r.Post("/users/{id}/reset-password", admin.ResetPassword)
+		r.Post("/users/{id}/galleries/{galleryID}/delete", admin.DeleteGallery)
+		r.Post("/users/{id}/impersonate", admin.Impersonate)
+	})
+
+	r.Route("/api/v1", func(r chi.Router) {
+		r.NotFound(api.NotFound)
+		r.MethodNotAllowed(api.MethodNotAllowed)
+		r.With(userMw.RequireScope(models.ScopeUserRead), api.RequireUser).Get("/me", api.Me)
+		r.Route("/galleries", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(userMw.RequireScope(models.ScopeGalleriesRead))
+				r.Use(api.RequireUser)
+				r.Get("/", api.Galleries)
+				r.Get("/{id}", api.Gallery)
+				r.Get("/{id}/images", api.Images)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(userMw.RequireScope(models.ScopeGalleriesWrite))
+				r.Use(api.RequireUser)
+				r.With(api.RequireVerifiedUser, apiGalleryLimiter.Handler).Post("/", api.CreateGallery)
+				r.Patch("/{id}", api.UpdateGallery)
+				r.Delete("/{id}", api.DeleteGallery)
+				r.With(apiUploadLimiter.Handler).Post("/{id}/images", api.UploadImage)
+				r.Delete("/{id}/images/{filename}", api.DeleteImage)
+			})
 		})
 	})
 
@@ -143,3 +443,16 @@ func main() {
 		panic(err)
 	}
 }
+
+func runPeriodically(interval time.Duration, name string, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := job(context.Background())
+		if err != nil {
+			log.Printf("ERROR: %v: %v\n", name, err.Error())
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,52 @@
+// Command import-images creates the rows of the images table for the image
+// files in the configured storage, which were uploaded before the table
+// existed. It can be run repeatedly, the files having a row already are left
+// alone.
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/szykes/simple-backend/config"
+	"github.com/szykes/simple-backend/migrations"
+	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/storage"
+)
+
+func main() {
+	cfg, err := config.LoadDotEnvConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		panic(err)
+	}
+
+	imageStorage, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+
+	galleryService := models.GalleryService{
+		DB:      db,
+		Storage: imageStorage,
+	}
+
+	imported, skipped, err := galleryService.ImportFiles(context.Background())
+	for _, file := range skipped {
+		log.Printf("INFO: import images: %v is not a valid image, skipped\n", file)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: import images: %v\n", err.Error())
+	}
+	log.Printf("INFO: import images: %v images are imported\n", imported)
+}
@@ -2,12 +2,26 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/szykes/simple-backend/errors"
 	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/password"
+	"github.com/szykes/simple-backend/storage"
+	"golang.org/x/crypto/bcrypt"
 )
 
+type OIDCProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
 type Config struct {
 	PSQL models.PostgresCfg
 	CSRF struct {
@@ -15,8 +29,66 @@ type Config struct {
 		Secure bool
 	}
 	Server struct {
-		Host string
-		Port string
+		Host    string
+		Port    string
+		BaseURL string
+	}
+	Password struct {
+		MinLength   int
+		MaxLength   int
+		BreachedDir string
+		Hasher      string
+		Bcrypt      struct {
+			Cost int
+		}
+		Argon2 struct {
+			Time    int
+			Memory  int
+			Threads int
+		}
+	}
+	Session struct {
+		Lifetime            time.Duration
+		IdleTimeout         time.Duration
+		RememberLifetime    time.Duration
+		RememberIdleTimeout time.Duration
+	}
+	TOTP struct {
+		Issuer string
+	}
+	Account struct {
+		DeletionGracePeriod time.Duration
+		ExportDir           string
+	}
+	Registration struct {
+		Mode           string
+		AllowedDomains []string
+	}
+	Attempts struct {
+		MaxFailures      int
+		MaxFailuresPerIP int
+		Lockout          time.Duration
+		MaxLockout       time.Duration
+		Window           time.Duration
+	}
+	OIDC      []OIDCProvider
+	RateLimit struct {
+		Store            string
+		AuthPerMinute    int
+		GalleriesPerHour int
+		UploadsPerMinute int
+	}
+	Storage storage.Config
+	Uploads models.UploadLimits
+	Mail    struct {
+		From string
+		SMTP struct {
+			Host     string
+			Port     string
+			Username string
+			Password string
+		}
+		Outbox string
 	}
 }
 
@@ -59,9 +131,215 @@ func LoadDotEnvConfig() (*Config, error) {
 	if cfg.Server.Port, err = stringEnv("SERVER_PORT"); err != nil {
 		return nil, errors.Wrap(err, "failed to load .env file")
 	}
+	if cfg.Server.BaseURL, err = stringEnv("SERVER_BASE_URL"); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	if cfg.Password.MinLength, err = optionalIntEnv("PASSWORD_MIN_LENGTH", password.DefaultMinLength); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Password.MaxLength, err = optionalIntEnv("PASSWORD_MAX_LENGTH", password.DefaultMaxLength); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	cfg.Password.BreachedDir = optionalStringEnv("PASSWORD_BREACHED_DIR", "")
+	cfg.Password.Hasher = optionalStringEnv("PASSWORD_HASHER", "bcrypt")
+	if cfg.Password.Bcrypt.Cost, err = optionalIntEnv("BCRYPT_COST", bcrypt.DefaultCost); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Password.Argon2.Time, err = optionalIntEnv("ARGON2_TIME", password.DefaultArgon2Time); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Password.Argon2.Memory, err = optionalIntEnv("ARGON2_MEMORY_KIB", password.DefaultArgon2Memory); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Password.Argon2.Threads, err = optionalIntEnv("ARGON2_THREADS", password.DefaultArgon2Threads); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	if cfg.Session.Lifetime, err = optionalDurationEnv("SESSION_LIFETIME", models.DefaultSessionLifetime); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Session.IdleTimeout, err = optionalDurationEnv("SESSION_IDLE_TIMEOUT", models.DefaultSessionIdleTimeout); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Session.RememberLifetime, err = optionalDurationEnv("SESSION_REMEMBER_LIFETIME", models.DefaultRememberLifetime); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Session.RememberIdleTimeout, err = optionalDurationEnv("SESSION_REMEMBER_IDLE_TIMEOUT", models.DefaultRememberIdleTimeout); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	cfg.TOTP.Issuer = optionalStringEnv("TOTP_ISSUER", "Szykes")
+
+	if cfg.Account.DeletionGracePeriod, err = optionalDurationEnv("ACCOUNT_DELETION_GRACE_PERIOD", models.DefaultDeletionGracePeriod); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	cfg.Account.ExportDir = optionalStringEnv("EXPORT_DIR", models.DefaultExportDir)
+
+	if cfg.Registration.Mode, cfg.Registration.AllowedDomains, err = registration(); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	if cfg.Attempts.MaxFailures, err = optionalIntEnv("LOGIN_MAX_FAILURES", models.DefaultMaxFailures); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Attempts.MaxFailuresPerIP, err = optionalIntEnv("LOGIN_MAX_FAILURES_PER_IP", models.DefaultMaxFailuresPerIP); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Attempts.Lockout, err = optionalDurationEnv("LOGIN_LOCKOUT", models.DefaultLockout); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Attempts.MaxLockout, err = optionalDurationEnv("LOGIN_MAX_LOCKOUT", models.DefaultMaxLockout); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Attempts.Window, err = optionalDurationEnv("LOGIN_ATTEMPT_WINDOW", models.DefaultAttemptWindow); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	cfg.RateLimit.Store = optionalStringEnv("RATE_LIMIT_STORE", "memory")
+	if cfg.RateLimit.AuthPerMinute, err = optionalIntEnv("RATE_LIMIT_AUTH_PER_MINUTE", 20); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.RateLimit.GalleriesPerHour, err = optionalIntEnv("RATE_LIMIT_GALLERIES_PER_HOUR", 20); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.RateLimit.UploadsPerMinute, err = optionalIntEnv("RATE_LIMIT_UPLOADS_PER_MINUTE", 30); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	if cfg.Storage, err = storageConfig(); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	if cfg.Uploads, err = uploadLimits(); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+
+	if cfg.Mail.From, err = stringEnv("MAIL_FROM"); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
+	cfg.Mail.SMTP.Host = optionalStringEnv("SMTP_HOST", "")
+	cfg.Mail.SMTP.Port = optionalStringEnv("SMTP_PORT", "587")
+	cfg.Mail.SMTP.Username = optionalStringEnv("SMTP_USERNAME", "")
+	cfg.Mail.SMTP.Password = optionalStringEnv("SMTP_PASSWORD", "")
+	cfg.Mail.Outbox = optionalStringEnv("MAIL_OUTBOX", "")
+
+	if cfg.OIDC, err = oidcProviders(); err != nil {
+		return nil, errors.Wrap(err, "failed to load .env file")
+	}
 	return &cfg, nil
 }
 
+// oidcProviders loads the providers listed by OIDC_PROVIDERS, e.g. "google"
+// needs OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID and OIDC_GOOGLE_CLIENT_SECRET.
+func oidcProviders() ([]OIDCProvider, error) {
+	var providers []OIDCProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := OIDCProvider{
+			Name:        name,
+			DisplayName: optionalStringEnv(prefix+"DISPLAY_NAME", name),
+		}
+		var err error
+		if provider.Issuer, err = stringEnv(prefix + "ISSUER"); err != nil {
+			return nil, errors.Wrap(err, "oidc providers")
+		}
+		if provider.ClientID, err = stringEnv(prefix + "CLIENT_ID"); err != nil {
+			return nil, errors.Wrap(err, "oidc providers")
+		}
+		if provider.ClientSecret, err = stringEnv(prefix + "CLIENT_SECRET"); err != nil {
+			return nil, errors.Wrap(err, "oidc providers")
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// registration loads REGISTRATION_MODE, and REGISTRATION_ALLOWED_DOMAINS, e.g.
+// "example.com,example.org", in domains mode.
+func registration() (string, []string, error) {
+	mode := optionalStringEnv("REGISTRATION_MODE", models.RegistrationOpen)
+	switch mode {
+	case models.RegistrationOpen, models.RegistrationClosed, models.RegistrationInvite:
+		return mode, nil, nil
+	case models.RegistrationDomains:
+	default:
+		return "", nil, errors.New("invalid registration mode", "mode", mode)
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("REGISTRATION_ALLOWED_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return "", nil, errors.New("no allowed domains", "key", "REGISTRATION_ALLOWED_DOMAINS")
+	}
+	return mode, domains, nil
+}
+
+// storageConfig loads STORAGE_BACKEND, and the settings of the backend, e.g.
+// STORAGE_DIR for local, or the S3_* ones for s3.
+func storageConfig() (storage.Config, error) {
+	cfg := storage.Config{
+		Backend: optionalStringEnv("STORAGE_BACKEND", storage.BackendLocal),
+	}
+
+	var err error
+	switch cfg.Backend {
+	case storage.BackendLocal:
+		cfg.Local.Dir = optionalStringEnv("STORAGE_DIR", storage.DefaultLocalDir)
+	case storage.BackendS3:
+		if cfg.S3.Endpoint, err = stringEnv("S3_ENDPOINT"); err != nil {
+			return cfg, errors.Wrap(err, "storage config")
+		}
+		cfg.S3.Region = optionalStringEnv("S3_REGION", "us-east-1")
+		if cfg.S3.Bucket, err = stringEnv("S3_BUCKET"); err != nil {
+			return cfg, errors.Wrap(err, "storage config")
+		}
+		if cfg.S3.AccessKeyID, err = stringEnv("S3_ACCESS_KEY_ID"); err != nil {
+			return cfg, errors.Wrap(err, "storage config")
+		}
+		if cfg.S3.SecretAccessKey, err = stringEnv("S3_SECRET_ACCESS_KEY"); err != nil {
+			return cfg, errors.Wrap(err, "storage config")
+		}
+		cfg.S3.PathStyle = optionalStringEnv("S3_PATH_STYLE", "false") == "true"
+	case storage.BackendMemory:
+	default:
+		return cfg, errors.New("invalid storage backend", "backend", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+// uploadLimits loads the limits of the uploads, the sizes are given in MB.
+func uploadLimits() (models.UploadLimits, error) {
+	var limits models.UploadLimits
+
+	maxFileSizeMB, err := optionalIntEnv("UPLOAD_MAX_FILE_SIZE_MB", models.DefaultMaxFileSize>>20)
+	if err != nil {
+		return limits, errors.Wrap(err, "upload limits")
+	}
+	limits.MaxFileSize = int64(maxFileSizeMB) << 20
+
+	if limits.MaxImagesPerGallery, err = optionalIntEnv("GALLERY_MAX_IMAGES", models.DefaultMaxImagesPerGallery); err != nil {
+		return limits, errors.Wrap(err, "upload limits")
+	}
+
+	quotaMB, err := optionalIntEnv("STORAGE_QUOTA_MB", models.DefaultStorageQuota>>20)
+	if err != nil {
+		return limits, errors.Wrap(err, "upload limits")
+	}
+	limits.StorageQuota = int64(quotaMB) << 20
+
+	return limits, nil
+}
+
 func stringEnv(key string) (string, error) {
 	value := os.Getenv(key)
 	if len(value) == 0 {
@@ -70,6 +348,14 @@ func stringEnv(key string) (string, error) {
 	return value, nil
 }
 
+func optionalStringEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
+
 func boolEnv(key string) (bool, error) {
 	env := os.Getenv(key)
 	switch env {
@@ -81,3 +367,27 @@ func boolEnv(key string) (bool, error) {
 		return false, errors.New("non Boolean value", "key", key)
 	}
 }
+
+func optionalIntEnv(key string, fallback int) (int, error) {
+	env := os.Getenv(key)
+	if len(env) == 0 {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(env)
+	if err != nil {
+		return 0, errors.Wrap(err, "non integer value", "key", key)
+	}
+	return value, nil
+}
+
+func optionalDurationEnv(key string, fallback time.Duration) (time.Duration, error) {
+	env := os.Getenv(key)
+	if len(env) == 0 {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(env)
+	if err != nil {
+		return 0, errors.Wrap(err, "non duration value", "key", key)
+	}
+	return value, nil
+}
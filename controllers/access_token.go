@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+var accessTokenLifetimes = []int{7, 30, 90, 365} // days
+
+type accessTokensData struct {
+	Tokens    []models.AccessToken
+	Scopes    []string
+	Lifetimes []int
+	// NewToken is shown only once, right after it is created.
+	NewToken string
+}
+
+func (u *Users) AccessTokens(w http.ResponseWriter, r *http.Request) {
+	u.executeAccessTokens(w, r, "")
+}
+
+func (u *Users) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("DEBUG: create access token: %v\n", err.Error())
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	days := accessTokenLifetimes[1]
+	if r.FormValue("days") != "" {
+		days, err = strconv.Atoi(r.FormValue("days"))
+		// Note: only the offered lifetimes are accepted, a huge number of days would overflow the duration.
+		if err != nil || !slices.Contains(accessTokenLifetimes, days) {
+			err = errors.Public(errors.Wrap(models.ErrInvalidLifetime, "create access token", "days", r.FormValue("days")),
+				"Choose one of the offered expirations.")
+			u.executeAccessTokens(w, r, "", err)
+			return
+		}
+	}
+	accessToken, err := u.AccessTokenService.Create(r.Context(), user.ID, r.FormValue("name"), r.Form["scopes"],
+		time.Duration(days)*24*time.Hour)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidLifetime):
+			err = errors.Public(err, "Choose one of the offered expirations.")
+		case errors.Is(err, models.ErrNameEmpty):
+			err = errors.Public(err, "The name must not be empty.")
+		case errors.Is(err, models.ErrInvalidScope):
+			err = errors.Public(err, "Choose at least one scope.")
+		default:
+			log.Printf("ERROR: create access token: %v\n", err.Error())
+		}
+		u.executeAccessTokens(w, r, "", err)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditAccessTokenCreated, &user.ID, &user.ID,
+		map[string]any{"access_token_id": accessToken.ID, "name": accessToken.Name}))
+
+	u.executeAccessTokens(w, r, accessToken.Token)
+}
+
+func (u *Users) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("DEBUG: revoke access token: %v\n", err.Error())
+		http.Error(w, "Access token is not found", http.StatusNotFound)
+		return
+	}
+
+	user := custctx.User(r.Context())
+	err = u.AccessTokenService.Delete(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Access token is not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: revoke access token: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditAccessTokenRevoked, auditActorID(r), &user.ID,
+		map[string]any{"access_token_id": id}))
+
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
+}
+
+func (u *Users) executeAccessTokens(w http.ResponseWriter, r *http.Request, newToken string, errs ...error) {
+	user := custctx.User(r.Context())
+
+	tokens, err := u.AccessTokenService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: access tokens: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := accessTokensData{
+		Tokens:    tokens,
+		Scopes:    models.Scopes,
+		Lifetimes: accessTokenLifetimes,
+		NewToken:  newToken,
+	}
+	u.Templates.AccessTokens.Execute(w, r, data, errs...)
+}
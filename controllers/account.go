@@ -0,0 +1,307 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/oidc"
+	"github.com/szykes/simple-backend/password"
+)
+
+type accountData struct {
+	Name          string
+	Email         string
+	EmailVerified bool
+	PendingEmail  string
+	Export        *models.DataExport
+	Identities    []models.Identity
+	Providers     []*oidc.Provider
+	// HasPassword is false for the users signed up by a provider, they confirm
+	// the sensitive changes by a connected account instead.
+	HasPassword     bool
+	Reauthenticated bool
+	ReauthProviders []*oidc.Provider
+	InviteOnly      bool
+	Message         string
+}
+
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	data, err := u.accountData(r)
+	if err != nil {
+		log.Printf("ERROR: account: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("updated") {
+	case "name":
+		data.Message = "Your name has been updated."
+	case "password":
+		data.Message = "Your password has been changed. Your other sessions have been signed out."
+	case "email":
+		data.Message = "Your email address has been changed."
+	case "identity":
+		data.Message = "The account has been connected."
+	case "export":
+		data.Message = "We are preparing your data. We will email you a download link when it is ready."
+	case "reauth":
+		data.Message = "You have confirmed it is you. You can change your email address or delete your account now."
+	}
+	u.Templates.Account.Execute(w, r, data)
+}
+
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	err := u.UserService.UpdateName(r.Context(), user.ID, r.FormValue("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNameEmpty) {
+			err = errors.Public(err, "The name must not be empty.")
+		} else {
+			log.Printf("ERROR: update name: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me?updated=name", http.StatusFound)
+}
+
+func (u *Users) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	current := custctx.Session(r.Context())
+	newPassword := r.FormValue("newPassword")
+
+	if newPassword != r.FormValue("confirmPassword") {
+		u.executeAccount(w, r, errors.Public(nil, "The given passwords do not match."))
+		return
+	}
+
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, r.FormValue("currentPassword"))
+	if err != nil {
+		if errors.Is(err, models.ErrWrongPw) {
+			err = errors.Public(err, "The current password is wrong.")
+		} else {
+			log.Printf("ERROR: update password: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	err = u.UserService.UpdatePassword(r.Context(), user.ID, newPassword)
+	if err != nil {
+		if !errors.Is(err, password.ErrPolicy) {
+			log.Printf("ERROR: update password: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditPasswordChanged, &user.ID, &user.ID, nil))
+
+	// Note: whoever knew the old password should not stay signed in.
+	err = u.SessionService.DeleteOthers(r.Context(), user.ID, current.ID)
+	if err != nil {
+		log.Printf("ERROR: update password: %v\n", err.Error())
+	}
+
+	http.Redirect(w, r, "/users/me?updated=password", http.StatusFound)
+}
+
+func (u *Users) UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	newEmail := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+
+	if newEmail == user.Email {
+		u.executeAccount(w, r, errors.Public(nil, "That is your current email address."))
+		return
+	}
+
+	err := u.confirmIdentity(r)
+	if err != nil {
+		if !errors.Is(err, models.ErrWrongPw) {
+			log.Printf("ERROR: update email: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	change, err := u.EmailChangeService.Create(r.Context(), user.ID, newEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrEmailTaken):
+			err = errors.Public(err, "That email address is already associated with an account.")
+		case errors.Is(err, models.ErrEmailInvalid):
+			err = errors.Public(err, "The email address is not valid.")
+		default:
+			log.Printf("ERROR: update email: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	err = u.EmailService.ConfirmEmailChange(r.Context(), change.NewEmail, change.Token)
+	if err != nil {
+		log.Printf("ERROR: update email: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u *Users) CancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	err := u.EmailChangeService.Cancel(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: cancel email change: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u *Users) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	change, err := u.EmailChangeService.Consume(r.Context(), r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired):
+			err = errors.Public(err, "The confirmation link is invalid or expired.")
+		case errors.Is(err, models.ErrEmailTaken):
+			err = errors.Public(err, "That email address is already associated with an account.")
+		default:
+			log.Printf("ERROR: confirm email: %v\n", err.Error())
+		}
+		u.Templates.ConfirmEmail.Execute(w, r, nil, err)
+		return
+	}
+
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditEmailChanged, &change.UserID, &change.UserID,
+		map[string]any{"old_email": change.OldEmail, "new_email": change.NewEmail}))
+
+	err = u.EmailService.EmailChanged(r.Context(), change.OldEmail, change.NewEmail)
+	if err != nil {
+		log.Printf("ERROR: confirm email: %v\n", err.Error())
+	}
+
+	user := custctx.User(r.Context())
+	if user == nil || user.ID != change.UserID {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me?updated=email", http.StatusFound)
+}
+
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	err := u.confirmIdentity(r)
+	if err != nil {
+		if !errors.Is(err, models.ErrWrongPw) {
+			log.Printf("ERROR: delete account: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	err = u.AccountDeletionService.Request(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: delete account: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditAccountDeletionRequest, &user.ID, &user.ID, nil))
+
+	data := struct {
+		PurgeAt time.Time
+	}{
+		PurgeAt: u.AccountDeletionService.PurgeAt(time.Now()),
+	}
+
+	deleteCookie(w, CookieSessionName)
+	// Note: the user is signed out, so the template must not show the signed in navigation.
+	r = r.WithContext(custctx.WithUser(r.Context(), nil))
+	u.Templates.AccountDeleted.Execute(w, r, data)
+}
+
+// confirmIdentity checks the password, or, if the user has none, whether the
+// user confirmed it is them by a connected account recently.
+func (u *Users) confirmIdentity(r *http.Request) error {
+	user := custctx.User(r.Context())
+	if user.PasswordHash == "" {
+		session := custctx.Session(r.Context())
+		if session != nil && session.Reauthenticated() {
+			return nil
+		}
+		return errors.Public(errors.Wrap(models.ErrWrongPw, "confirm identity", "user ID", user.ID),
+			"Confirm it is you with a connected account first.")
+	}
+
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrWrongPw) {
+			err = errors.Public(err, "The password is wrong.")
+		}
+		return errors.Wrap(err, "confirm identity", "user ID", user.ID)
+	}
+	return nil
+}
+
+func (u *Users) executeAccount(w http.ResponseWriter, r *http.Request, errs ...error) {
+	data, err := u.accountData(r)
+	if err != nil {
+		log.Printf("ERROR: account: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.Account.Execute(w, r, data, errs...)
+}
+
+func (u *Users) accountData(r *http.Request) (*accountData, error) {
+	user := custctx.User(r.Context())
+	data := accountData{
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified(),
+	}
+
+	pendingEmail, err := u.EmailChangeService.Pending(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return nil, errors.Wrap(err, "account data", "user ID", user.ID)
+	}
+	data.PendingEmail = pendingEmail
+
+	export, err := u.DataExportService.ByUserID(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return nil, errors.Wrap(err, "account data", "user ID", user.ID)
+	}
+	data.Export = export
+
+	data.Identities, err = u.IdentityService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "account data", "user ID", user.ID)
+	}
+	data.Providers = u.OIDCProviders
+
+	data.HasPassword = user.PasswordHash != ""
+	session := custctx.Session(r.Context())
+	data.Reauthenticated = session != nil && session.Reauthenticated()
+	for _, provider := range u.OIDCProviders {
+		for _, identity := range data.Identities {
+			if identity.Provider == provider.Name {
+				data.ReauthProviders = append(data.ReauthProviders, provider)
+				break
+			}
+		}
+	}
+	data.InviteOnly = u.UserService.Registration.InviteOnly()
+
+	return &data, nil
+}
@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/mailer"
+	"github.com/szykes/simple-backend/models"
+)
+
+type Admin struct {
+	Templates struct {
+		Users template
+		User  template
+		Audit template
+	}
+	UserService          *models.UserService
+	SessionService       *models.SessionService
+	PasswordResetService *models.PasswordResetService
+	GalleryService       *models.GalleryService
+	EmailService         *mailer.Service
+	AuditService         *models.AuditService
+}
+
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	page = max(page, 0)
+	query := r.FormValue("q")
+
+	users, err := a.UserService.Search(r.Context(), query, page)
+	if err != nil {
+		log.Printf("ERROR: admin users: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Query    string
+		Users    []models.User
+		Page     int
+		PrevPage string
+		NextPage string
+	}{
+		Query: query,
+		Users: users,
+		Page:  page,
+	}
+	if page > 0 {
+		data.PrevPage = "/admin/users?" + url.Values{"q": {query}, "page": {strconv.Itoa(page - 1)}}.Encode()
+	}
+	if len(users) == cap(users) {
+		data.NextPage = "/admin/users?" + url.Values{"q": {query}, "page": {strconv.Itoa(page + 1)}}.Encode()
+	}
+	a.Templates.Users.Execute(w, r, data)
+}
+
+func (a *Admin) User(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+	a.executeUser(w, r, user, r.FormValue("done"))
+}
+
+func (a *Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, true)
+}
+
+func (a *Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, false)
+}
+
+func (a *Admin) SignOutUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.SessionService.DeleteAll(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: admin sign out user: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, models.AuditAllSessionsDeleted, auditActorID(r), &user.ID, nil))
+
+	redirectToAdminUser(w, r, user.ID, "signout")
+}
+
+func (a *Admin) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+
+	pwReset, err := a.PasswordResetService.Create(r.Context(), user.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			a.executeUser(w, r, user, "", errors.Public(err, "The password of a deleted user cannot be reset."))
+			return
+		}
+		log.Printf("ERROR: admin reset password: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	err = a.EmailService.ForgotPassword(r.Context(), user.Email, pwReset.Token)
+	if err != nil {
+		log.Printf("ERROR: admin reset password: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, models.AuditPasswordResetRequested, auditActorID(r), &user.ID, nil))
+
+	redirectToAdminUser(w, r, user.ID, "reset")
+}
+
+func (a *Admin) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+
+	galleryID, err := strconv.Atoi(chi.URLParam(r, "galleryID"))
+	if err != nil {
+		http.Error(w, "Gallery is not found", http.StatusNotFound)
+		return
+	}
+
+	// Note: GalleryService.ByID hides the galleries of the deleted users, so the galleries of the user are searched instead.
+	galleries, err := a.GalleryService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: admin delete gallery: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(galleries, func(gallery models.Gallery) bool { return gallery.ID == galleryID })
+	if i < 0 {
+		http.Error(w, "Gallery is not found", http.StatusNotFound)
+		return
+	}
+
+	err = a.GalleryService.Delete(r.Context(), galleryID)
+	if err != nil {
+		log.Printf("ERROR: admin delete gallery: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, models.AuditGalleryDeleted, auditActorID(r), &user.ID,
+		map[string]any{"gallery_id": galleryID, "title": galleries[i].Title}))
+
+	redirectToAdminUser(w, r, user.ID, "gallery")
+}
+
+func (a *Admin) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.UserService.SetDisabled(r.Context(), user.ID, disabled)
+	if err != nil {
+		log.Printf("ERROR: admin set disabled: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	action := models.AuditUserEnabled
+	if disabled {
+		action = models.AuditUserDisabled
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, action, auditActorID(r), &user.ID, nil))
+
+	if !disabled {
+		redirectToAdminUser(w, r, user.ID, "enable")
+		return
+	}
+
+	// Note: the sessions are not accepted anyway, but they should not come back when the user is enabled again.
+	err = a.SessionService.DeleteAll(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: admin set disabled: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminUser(w, r, user.ID, "disable")
+}
+
+func (a *Admin) executeUser(w http.ResponseWriter, r *http.Request, user *models.User, done string, errs ...error) {
+	sessions, err := a.SessionService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: admin user: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	galleries, err := a.GalleryService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: admin user: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		User      *models.User
+		Sessions  int
+		Galleries []models.Gallery
+		Message   string
+	}{
+		User:      user,
+		Sessions:  len(sessions),
+		Galleries: galleries,
+	}
+	switch done {
+	case "disable":
+		data.Message = "The user has been disabled and signed out."
+	case "enable":
+		data.Message = "The user has been enabled."
+	case "signout":
+		data.Message = "The user has been signed out everywhere."
+	case "reset":
+		data.Message = "A password reset email has been sent to the user."
+	case "gallery":
+		data.Message = "The gallery has been deleted."
+	}
+	a.Templates.User.Execute(w, r, data, errs...)
+}
+
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "User is not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	user, err := a.UserService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User is not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("ERROR: admin user by ID: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+func redirectToAdminUser(w http.ResponseWriter, r *http.Request, userID int, done string) {
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(userID)+"?done="+done, http.StatusFound)
+}
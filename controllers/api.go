@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+// API serves the JSON endpoints under /api/v1. The errors are JSON too, and
+// nothing is redirected.
+type API struct {
+	GalleryService *models.GalleryService
+	AuditService   *models.AuditService
+}
+
+type apiUser struct {
+	ID               int    `json:"id"`
+	Name             string `json:"name"`
+	Email            string `json:"email"`
+	EmailVerified    bool   `json:"email_verified"`
+	Role             string `json:"role"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+}
+
+type apiGallery struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Title         string     `json:"title"`
+	StripMetadata bool       `json:"strip_metadata"`
+	Images        []apiImage `json:"images,omitempty"`
+}
+
+type apiImage struct {
+	ID          int       `json:"id"`
+	Filename    string    `json:"filename"`
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Checksum    string    `json:"checksum"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// Renditions are the URLs of the downscaled copies by their names.
+	Renditions map[string]string `json:"renditions"`
+	Metadata   models.EXIF       `json:"metadata"`
+}
+
+// apiUpload is the answer of an upload, where some of the files failed.
+type apiUpload struct {
+	Images []apiImage       `json:"images"`
+	Errors []apiUploadError `json:"errors"`
+}
+
+// apiUploadError is the error of a file in the same shape as the other errors.
+type apiUploadError struct {
+	Filename string `json:"filename"`
+	jsonError
+}
+
+type apiGalleryRequest struct {
+	Title         string `json:"title"`
+	StripMetadata *bool  `json:"strip_metadata"`
+}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	return apiGallery{
+		ID:            gallery.ID,
+		UserID:        gallery.UserID,
+		Title:         gallery.Title,
+		StripMetadata: gallery.StripMetadata,
+	}
+}
+
+// newAPIImage shows the location only to the owner, unless the gallery keeps
+// it.
+func newAPIImage(r *http.Request, gallery *models.Gallery, image *models.Image) apiImage {
+	imageURL := fmt.Sprintf("/galleries/%d/images/%s", image.GalleryID, url.PathEscape(image.Filename))
+	renditions := make(map[string]string, len(models.Renditions))
+	for _, rendition := range models.Renditions {
+		if image.HasRendition(rendition) {
+			renditions[rendition.Name] = imageURL + "?size=" + rendition.Name
+		}
+	}
+
+	metadata := image.EXIF
+	if user := custctx.User(r.Context()); gallery.StripMetadata && (user == nil || user.ID != gallery.UserID) {
+		metadata = metadata.Shared()
+	}
+
+	return apiImage{
+		ID:          image.ID,
+		Filename:    image.Filename,
+		URL:         imageURL,
+		Size:        image.Size,
+		ContentType: image.ContentType,
+		Width:       image.Width,
+		Height:      image.Height,
+		Checksum:    image.Checksum,
+		UploadedAt:  image.UploadedAt,
+		Renditions:  renditions,
+		Metadata:    metadata,
+	}
+}
+
+func (a *API) Me(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	writeJSON(w, http.StatusOK, apiUser{
+		ID:               user.ID,
+		Name:             user.Name,
+		Email:            user.Email,
+		EmailVerified:    user.EmailVerified(),
+		Role:             user.Role,
+		TwoFactorEnabled: user.TwoFactorEnabled(),
+	})
+}
+
+func (a *API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	galleries, err := a.GalleryService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: api galleries: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := make([]apiGallery, 0, len(galleries))
+	for _, gallery := range galleries {
+		data = append(data, newAPIGallery(&gallery))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (a *API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	var req apiGalleryRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	title, err := apiGalleryTitle(req)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	gallery, err := a.GalleryService.Create(r.Context(), title, user.ID)
+	if err != nil {
+		log.Printf("ERROR: api create gallery: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if req.StripMetadata != nil && *req.StripMetadata != gallery.StripMetadata {
+		gallery.StripMetadata = *req.StripMetadata
+		err = a.GalleryService.Update(r.Context(), gallery)
+		if err != nil {
+			log.Printf("ERROR: api create gallery: %v\n", err.Error())
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d", gallery.ID))
+	writeJSON(w, http.StatusCreated, newAPIGallery(gallery))
+}
+
+func (a *API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, false)
+	if !ok {
+		return
+	}
+
+	images, err := a.GalleryService.Images(r.Context(), gallery.ID)
+	if err != nil {
+		log.Printf("ERROR: api gallery: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := newAPIGallery(gallery)
+	data.Images = make([]apiImage, 0, len(images))
+	for _, image := range images {
+		data.Images = append(data.Images, newAPIImage(r, gallery, &image))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (a *API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, true)
+	if !ok {
+		return
+	}
+
+	var req apiGalleryRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Note: the title can be left out, if only the stripping is changed.
+	if req.Title != "" || req.StripMetadata == nil {
+		gallery.Title, err = apiGalleryTitle(req)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	if req.StripMetadata != nil {
+		gallery.StripMetadata = *req.StripMetadata
+	}
+
+	err = a.GalleryService.Update(r.Context(), gallery)
+	if err != nil {
+		log.Printf("ERROR: api update gallery: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+func (a *API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, true)
+	if !ok {
+		return
+	}
+
+	err := a.GalleryService.Delete(r.Context(), gallery.ID)
+	if err != nil {
+		log.Printf("ERROR: api delete gallery: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, models.AuditGalleryDeleted, auditActorID(r), &gallery.UserID,
+		map[string]any{"gallery_id": gallery.ID, "title": gallery.Title}))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, false)
+	if !ok {
+		return
+	}
+
+	images, err := a.GalleryService.Images(r.Context(), gallery.ID)
+	if err != nil {
+		log.Printf("ERROR: api images: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := make([]apiImage, 0, len(images))
+	for _, image := range images {
+		data = append(data, newAPIImage(r, gallery, &image))
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// UploadImage accepts the same multipart form as the web page, the files are
+// in the images field.
+func (a *API) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, true)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, a.GalleryService.MaxUploadSize())
+	err := r.ParseMultipartForm(a.GalleryService.MaxFileSize())
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errors.Public(err, "The upload is too large."))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, errors.Public(err, "The request body must be a multipart form."))
+		return
+	}
+
+	fileHeaders := r.MultipartForm.File["images"]
+	if len(fileHeaders) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, errors.Public(nil, "Upload at least one file in the images field."))
+		return
+	}
+
+	// Note: the files are independent, so a failed one does not stop the rest, and the stored ones are reported.
+	data := apiUpload{
+		Images: make([]apiImage, 0, len(fileHeaders)),
+		Errors: []apiUploadError{},
+	}
+	var firstStatus int
+	var firstErr error
+	for _, fileHeader := range fileHeaders {
+		image, err := createImage(r.Context(), a.GalleryService, gallery.ID, fileHeader)
+		if err != nil {
+			status, err := uploadError(fileHeader.Filename, err)
+			if firstErr == nil {
+				firstStatus, firstErr = status, err
+			}
+			data.Errors = append(data.Errors, apiUploadError{
+				Filename:  fileHeader.Filename,
+				jsonError: newJSONError(status, err),
+			})
+			continue
+		}
+		data.Images = append(data.Images, newAPIImage(r, gallery, image))
+	}
+
+	switch {
+	case firstErr == nil:
+		writeJSON(w, http.StatusCreated, data.Images)
+	case len(data.Images) == 0:
+		writeJSONError(w, firstStatus, firstErr)
+	default:
+		writeJSON(w, http.StatusMultiStatus, data)
+	}
+}
+
+// uploadError is the status and the error of a file, which could not be
+// uploaded.
+func uploadError(filename string, err error) (int, error) {
+	var fileErr models.FileError
+	switch {
+	case errors.As(err, &fileErr) && fileErr.Issue == models.IssueTooManyPixels:
+		msg := fmt.Sprintf("%v is too large. The images can have at most %d megapixels.", filename, models.MaxImagePixels/1_000_000)
+		return http.StatusBadRequest, errors.Public(err, msg)
+	case errors.As(err, &fileErr):
+		msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif and jpeg files can be uploaded.", filename)
+		return http.StatusBadRequest, errors.Public(err, msg)
+	case errors.Is(err, models.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge, err
+	case errors.Is(err, models.ErrGalleryFull):
+		return http.StatusConflict, err
+	case errors.Is(err, models.ErrStorageQuota):
+		return http.StatusForbidden, err
+	default:
+		log.Printf("ERROR: api upload image: %v\n", err.Error())
+		return http.StatusInternalServerError, err
+	}
+}
+
+func (a *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	gallery, ok := a.galleryByID(w, r, true)
+	if !ok {
+		return
+	}
+
+	err := a.GalleryService.DeleteImage(r.Context(), gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, errors.Public(err, "The image is not found."))
+			return
+		}
+		log.Printf("ERROR: api delete image: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	recordAudit(r, a.AuditService, newAuditEvent(r, models.AuditImageDeleted, auditActorID(r), &gallery.UserID,
+		map[string]any{"gallery_id": gallery.ID, "filename": filename}))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequireUser is the JSON counterpart of UserMiddleware.RequireUser.
+func (a *API) RequireUser(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := custctx.User(r.Context())
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errors.Public(nil, "Sign in or send an access token."))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireVerifiedUser is the JSON counterpart of
+// UserMiddleware.RequireVerifiedUser.
+func (a *API) RequireVerifiedUser(handler http.Handler) http.Handler {
+	return a.RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := custctx.User(r.Context())
+		if !user.EmailVerified() {
+			writeJSONError(w, http.StatusForbidden, errors.Public(nil, "Verify your email address first."))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// NotFound replaces the plain text 404 of the router under /api.
+func (a *API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, nil)
+}
+
+func (a *API) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusMethodNotAllowed, nil)
+}
+
+// RateLimited is the Reject of the rate limiters under /api.
+func (a *API) RateLimited(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusTooManyRequests, errors.Public(nil, "Too many requests, try again later."))
+}
+
+// galleryByID writes the error response itself, if the gallery cannot be
+// used.
+func (a *API) galleryByID(w http.ResponseWriter, r *http.Request, mustOwn bool) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, errors.Public(err, "The gallery is not found."))
+		return nil, false
+	}
+
+	gallery, err := a.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, errors.Public(err, "The gallery is not found."))
+			return nil, false
+		}
+		log.Printf("ERROR: api gallery by ID: %v\n", err.Error())
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	user := custctx.User(r.Context())
+	if mustOwn && gallery.UserID != user.ID {
+		writeJSONError(w, http.StatusForbidden, errors.Public(nil, "You are not allowed to edit this gallery."))
+		return nil, false
+	}
+	return gallery, true
+}
+
+func apiGalleryTitle(req apiGalleryRequest) (string, error) {
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		return "", errors.Public(nil, "The title must not be empty.")
+	}
+	return title, nil
+}
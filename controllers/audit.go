@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/models"
+)
+
+func newAuditEvent(r *http.Request, action string, actorID, targetID *int, details map[string]any) models.AuditEvent {
+	return models.AuditEvent{
+		ActorID:   actorID,
+		Action:    action,
+		TargetID:  targetID,
+		IPAddress: clientIP(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+	}
+}
+
+// recordAudit records the event, but a failure only gets logged, so the
+// request goes on.
+func recordAudit(r *http.Request, service *models.AuditService, event models.AuditEvent) {
+	err := service.Record(r.Context(), event)
+	if err != nil {
+		log.Printf("ERROR: record audit event: %v\n", err.Error())
+	}
+}
+
+// auditActorID is the ID of the signed in user, or the admin's during an
+// impersonation.
+func auditActorID(r *http.Request) *int {
+	if admin := custctx.Impersonator(r.Context()); admin != nil {
+		return &admin.ID
+	}
+	if user := custctx.User(r.Context()); user != nil {
+		return &user.ID
+	}
+	return nil
+}
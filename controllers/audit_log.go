@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/models"
+)
+
+var auditDescriptions = map[string]string{
+	models.AuditSignUp:                 "Account created",
+	models.AuditSignIn:                 "Signed in",
+	models.AuditSignInFailed:           "Failed sign in",
+	models.AuditSignOut:                "Signed out",
+	models.AuditPasswordResetRequested: "Password reset requested",
+	models.AuditPasswordReset:          "Password reset",
+	models.AuditPasswordChanged:        "Password changed",
+	models.AuditEmailChanged:           "Email address changed",
+	models.AuditSessionDeleted:         "Session revoked",
+	models.AuditOtherSessionsDeleted:   "Signed out everywhere else",
+	models.AuditAllSessionsDeleted:     "Signed out everywhere",
+	models.AuditTwoFactorEnabled:       "Two-factor authentication enabled",
+	models.AuditTwoFactorDisabled:      "Two-factor authentication disabled",
+	models.AuditIdentityLinked:         "External account connected",
+	models.AuditIdentityUnlinked:       "External account disconnected",
+	models.AuditAccessTokenCreated:     "Access token created",
+	models.AuditAccessTokenRevoked:     "Access token revoked",
+	models.AuditAccountDeletionRequest: "Account deletion requested",
+	models.AuditUserDisabled:           "Account disabled",
+	models.AuditUserEnabled:            "Account enabled",
+	models.AuditGalleryDeleted:         "Gallery deleted",
+	models.AuditImageDeleted:           "Image deleted",
+	models.AuditImpersonationStart:     "Impersonation by support started",
+	models.AuditImpersonationStop:      "Impersonation by support stopped",
+}
+
+type auditRow struct {
+	CreatedAt   time.Time
+	Action      string
+	Description string
+	Actor       string
+	Target      string
+	IPAddress   string
+	UserAgent   string
+	Details     string
+	// ByOther tells whether somebody else, e.g. an admin, did it to the user.
+	ByOther bool
+}
+
+func newAuditRow(event models.AuditEvent) auditRow {
+	row := auditRow{
+		CreatedAt:   event.CreatedAt,
+		Action:      event.Action,
+		Description: auditDescriptions[event.Action],
+		Actor:       event.ActorEmail,
+		Target:      event.TargetEmail,
+		IPAddress:   event.IPAddress,
+		UserAgent:   event.UserAgent,
+		ByOther:     event.ActorID != nil && event.TargetID != nil && *event.ActorID != *event.TargetID,
+	}
+	if row.Description == "" {
+		row.Description = event.Action
+	}
+
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	details := make([]string, 0, len(keys))
+	for _, key := range keys {
+		details = append(details, fmt.Sprintf("%s=%v", key, event.Details[key]))
+	}
+	row.Details = strings.Join(details, " ")
+	return row
+}
+
+// Activity shows the recent security activity of the user.
+func (u *Users) Activity(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	page = max(page, 0)
+
+	events, err := u.AuditService.Search(r.Context(), models.AuditFilter{UserID: user.ID}, page)
+	if err != nil {
+		log.Printf("ERROR: activity: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Events   []auditRow
+		PrevPage string
+		NextPage string
+	}
+	for _, event := range events {
+		data.Events = append(data.Events, newAuditRow(event))
+	}
+	if page > 0 {
+		data.PrevPage = "/users/me/activity?page=" + strconv.Itoa(page-1)
+	}
+	if len(events) == cap(events) {
+		data.NextPage = "/users/me/activity?page=" + strconv.Itoa(page+1)
+	}
+	u.Templates.Activity.Execute(w, r, data)
+}
+
+// Audit shows the audit log filtered by the action, the email of the actor
+// or the target, and the days.
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	page = max(page, 0)
+
+	query := url.Values{
+		"action": {r.FormValue("action")},
+		"email":  {strings.TrimSpace(r.FormValue("email"))},
+		"since":  {r.FormValue("since")},
+		"until":  {r.FormValue("until")},
+	}
+	filter := models.AuditFilter{
+		Action:    query.Get("action"),
+		UserEmail: query.Get("email"),
+	}
+	// Note: the invalid days are ignored, the date inputs of the browsers send valid ones anyway.
+	if since, err := time.Parse(time.DateOnly, query.Get("since")); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse(time.DateOnly, query.Get("until")); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+
+	events, err := a.AuditService.Search(r.Context(), filter, page)
+	if err != nil {
+		log.Printf("ERROR: admin audit: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Action   string
+		Email    string
+		Since    string
+		Until    string
+		Actions  []string
+		Events   []auditRow
+		PrevPage string
+		NextPage string
+	}{
+		Action:  query.Get("action"),
+		Email:   query.Get("email"),
+		Since:   query.Get("since"),
+		Until:   query.Get("until"),
+		Actions: models.AuditActions,
+	}
+	for _, event := range events {
+		data.Events = append(data.Events, newAuditRow(event))
+	}
+	if page > 0 {
+		query.Set("page", strconv.Itoa(page-1))
+		data.PrevPage = "/admin/audit?" + query.Encode()
+	}
+	if len(events) == cap(events) {
+		query.Set("page", strconv.Itoa(page+1))
+		data.NextPage = "/admin/audit?" + query.Encode()
+	}
+	a.Templates.Audit.Execute(w, r, data)
+}
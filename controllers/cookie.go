@@ -2,11 +2,18 @@ package controllers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/szykes/simple-backend/errors"
 )
 
-const CookieSessionName = "session"
+const (
+	CookieSessionName   = "session"
+	CookieTwoFactorName = "2fa"
+	CookieOIDCName      = "oidc"
+	// CookieImpersonatorName keeps the session of the admin during an impersonation.
+	CookieImpersonatorName = "impersonator"
+)
 
 func newCookie(name, value string) *http.Cookie {
 	return &http.Cookie{
@@ -22,6 +29,13 @@ func setCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, cookie)
 }
 
+func setCookieUntil(w http.ResponseWriter, name, value string, expiresAt time.Time) {
+	cookie := newCookie(name, value)
+	cookie.Expires = expiresAt
+	cookie.MaxAge = max(int(time.Until(expiresAt).Seconds()), 1)
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	cookie, err := r.Cookie(name)
 	if err != nil {
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+func (u *Users) RequestDataExport(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	_, err := u.DataExportService.Request(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: request data export: %v\n", err.Error())
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me?updated=export", http.StatusFound)
+}
+
+func (u *Users) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	export, err := u.DataExportService.Download(r.Context(), user.ID, r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "The download link is invalid or expired. Please ask for a new export.")
+		} else {
+			log.Printf("ERROR: download data export: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="my-data.zip"`)
+	w.Header().Set("Content-Type", "application/zip")
+	http.ServeFile(w, r, export.Path)
+}
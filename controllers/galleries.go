@@ -3,16 +3,20 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/szykes/simple-backend/custctx"
 	"github.com/szykes/simple-backend/errors"
 	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/storage"
 )
 
 type Galleries struct {
@@ -23,6 +27,7 @@ type Galleries struct {
 		Index template
 	}
 	GalleryService *models.GalleryService
+	AuditService   *models.AuditService
 }
 
 func (g *Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -60,22 +65,16 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
-	}
-
 	data := struct {
 		ID     int
 		Title  string
-		Images []Image
+		Images []galleryImage
 	}{
 		ID:    gallery.ID,
 		Title: gallery.Title,
 	}
 
-	images, err := g.GalleryService.Images(gallery.ID)
+	images, err := g.GalleryService.Images(r.Context(), gallery.ID)
 	if err != nil {
 		log.Printf("ERROR: gallery show: %v\n", err.Error())
 		http.Error(w, "Internal error", http.StatusInternalServerError)
@@ -83,11 +82,7 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, image := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+		data.Images = append(data.Images, newGalleryImage(&image))
 	}
 
 	g.Templates.Show.Execute(w, r, data)
@@ -100,20 +95,17 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
-	}
 	data := struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID            int
+		Title         string
+		StripMetadata bool
+		Images        []galleryImage
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:            gallery.ID,
+		Title:         gallery.Title,
+		StripMetadata: gallery.StripMetadata,
 	}
-	images, err := g.GalleryService.Images(gallery.ID)
+	images, err := g.GalleryService.Images(r.Context(), gallery.ID)
 	if err != nil {
 		log.Printf("ERROR: gallery edit: %v\n", err.Error())
 		http.Error(w, "Internal error", http.StatusInternalServerError)
@@ -121,11 +113,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, image := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+		data.Images = append(data.Images, newGalleryImage(&image))
 	}
 	g.Templates.Edit.Execute(w, r, data)
 }
@@ -138,6 +126,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = r.FormValue("title")
+	gallery.StripMetadata = r.FormValue("stripMetadata") == "true"
 	err = g.GalleryService.Update(r.Context(), gallery)
 	if err != nil {
 		log.Printf("ERROR: gallery update: %v\n", err.Error())
@@ -156,6 +145,7 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 	var data struct {
 		Galleries []Gallery
+		Usage     *models.StorageUsage
 	}
 
 	user := custctx.User(r.Context())
@@ -166,6 +156,13 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data.Usage, err = g.GalleryService.StorageUsage(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: gallery index: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
 			ID:    gallery.ID,
@@ -189,6 +186,8 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, g.AuditService, newAuditEvent(r, models.AuditGalleryDeleted, auditActorID(r), &gallery.UserID,
+		map[string]any{"gallery_id": gallery.ID, "title": gallery.Title}))
 
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
@@ -203,18 +202,22 @@ func (g *Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := g.GalleryService.Image(galleryID, filename)
+	content, object, err := g.GalleryService.OpenImage(r.Context(), galleryID, filename, r.FormValue("size"))
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
 			http.Error(w, "Image not found", http.StatusNotFound)
-		} else {
+		case errors.Is(err, models.ErrUnknownRendition):
+			http.Error(w, "Unknown size", http.StatusBadRequest)
+		default:
 			http.Error(w, "Internal error", http.StatusInternalServerError)
 		}
 		log.Printf("ERROR: image: %v\n", err.Error())
 		return
 	}
+	defer content.Close()
 
-	http.ServeFile(w, r, image.Path)
+	serveObject(w, r, filename, content, object)
 }
 
 func (g *Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
@@ -224,8 +227,14 @@ func (g *Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = r.ParseMultipartForm(5 << 20) // 5 MB
+	r.Body = http.MaxBytesReader(w, r.Body, g.GalleryService.MaxUploadSize())
+	err = r.ParseMultipartForm(g.GalleryService.MaxFileSize())
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "The upload is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		log.Printf("ERROR: upload image: %v\n", err.Error())
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
@@ -233,23 +242,32 @@ func (g *Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 
 	fileHeaders := r.MultipartForm.File["images"]
 	for _, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
-		if err != nil {
-			log.Printf("ERROR: upload image: %v\n", err.Error())
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
-		}
-		defer file.Close()
-
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		_, err = createImage(r.Context(), g.GalleryService, gallery.ID, fileHeader)
 		if err != nil {
 			log.Printf("ERROR: upload image: %v\n", err.Error())
 			var fileErr models.FileError
+			if errors.As(err, &fileErr) && fileErr.Issue == models.IssueTooManyPixels {
+				msg := fmt.Sprintf("%v is too large. The images can have at most %d megapixels.", fileHeader.Filename, models.MaxImagePixels/1_000_000)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
 			if errors.As(err, &fileErr) {
 				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif ang jpeg files can be uploaded", fileHeader.Filename)
 				http.Error(w, msg, http.StatusBadRequest)
 				return
 			}
+			if errors.Is(err, models.ErrFileTooLarge) {
+				http.Error(w, publicMessage(err), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, models.ErrGalleryFull) {
+				http.Error(w, publicMessage(err), http.StatusConflict)
+				return
+			}
+			if errors.Is(err, models.ErrStorageQuota) {
+				http.Error(w, publicMessage(err), http.StatusForbidden)
+				return
+			}
 			http.Error(w, "Internal error", http.StatusInternalServerError)
 			return
 		}
@@ -258,6 +276,22 @@ func (g *Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// createImage stores an uploaded file, which is closed right after it, so a
+// large upload does not keep all of its files open.
+func createImage(ctx context.Context, galleryService *models.GalleryService, galleryID int, fileHeader *multipart.FileHeader) (*models.Image, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "filename", fileHeader.Filename)
+	}
+	defer file.Close()
+
+	image, err := galleryService.CreateImage(ctx, galleryID, fileHeader.Filename, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "filename", fileHeader.Filename)
+	}
+	return image, nil
+}
+
 func (g *Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(r)
 	gallery, err := g.galleryByID(r.Context(), w, r, userMustOwnGallery)
@@ -266,17 +300,76 @@ func (g *Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	err = g.GalleryService.DeleteImage(r.Context(), gallery.ID, filename)
 	if err != nil {
 		log.Printf("ERROR: delete image: %v\n", err.Error())
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, g.AuditService, newAuditEvent(r, models.AuditImageDeleted, auditActorID(r), &gallery.UserID,
+		map[string]any{"gallery_id": gallery.ID, "filename": filename}))
 
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// serveObject lets http.ServeContent handle the ranges and the conditional
+// requests, if the object can seek, e.g. a local file.
+func serveObject(w http.ResponseWriter, r *http.Request, name string, content io.Reader, object *storage.Object) {
+	if rs, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, object.ModTime, rs)
+		return
+	}
+
+	if object.ContentType != "" {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+	if object.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(object.Size, 10))
+	}
+	if !object.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", object.ModTime.UTC().Format(http.TimeFormat))
+	}
+	_, err := io.Copy(w, content)
+	if err != nil {
+		log.Printf("ERROR: serve object: %v\n", err.Error())
+	}
+}
+
+type galleryImage struct {
+	GalleryID       int
+	Filename        string
+	FilenameEscaped string
+	Src             string
+	Srcset          string
+	Large           string
+	Caption         string
+}
+
+// newGalleryImage lets the browser pick the smallest rendition, which is big
+// enough for the tile.
+func newGalleryImage(image *models.Image) galleryImage {
+	imageURL := fmt.Sprintf("/galleries/%d/images/%s", image.GalleryID, url.PathEscape(image.Filename))
+
+	srcset := make([]string, 0, len(models.Renditions)+1)
+	for _, rendition := range models.Renditions {
+		if image.HasRendition(rendition) {
+			srcset = append(srcset, fmt.Sprintf("%s?size=%s %dw", imageURL, rendition.Name, image.RenditionWidth(rendition)))
+		}
+	}
+	srcset = append(srcset, fmt.Sprintf("%s %dw", imageURL, image.Width))
+
+	return galleryImage{
+		GalleryID:       image.GalleryID,
+		Filename:        image.Filename,
+		FilenameEscaped: url.PathEscape(image.Filename),
+		Src:             imageURL + "?size=" + models.RenditionMedium,
+		Srcset:          strings.Join(srcset, ", "),
+		Large:           imageURL + "?size=" + models.RenditionLarge,
+		Caption:         image.EXIF.Summary(),
+	}
+}
+
 func (g *Galleries) filename(r *http.Request) string {
 	filename := chi.URLParam(r, "filename")
 	filename = filepath.Base(filename)
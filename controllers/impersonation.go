@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+// Impersonate signs the admin in as the user. The session of the admin is kept
+// aside in a cookie, so it can be restored when the impersonation stops.
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.userByID(w, r)
+	if !ok {
+		return
+	}
+	admin := custctx.User(r.Context())
+	adminSession := custctx.Session(r.Context())
+
+	switch {
+	case user.ID == admin.ID:
+		a.executeUser(w, r, user, "", errors.Public(nil, "You cannot impersonate yourself."))
+		return
+	case user.HasRole(models.RoleAdmin):
+		a.executeUser(w, r, user, "", errors.Public(nil, "Admins cannot be impersonated."))
+		return
+	case user.Disabled() || user.Deleted():
+		a.executeUser(w, r, user, "", errors.Public(nil, "Disabled or deleted users cannot be impersonated."))
+		return
+	}
+
+	adminToken, err := readCookie(r, CookieSessionName)
+	if err != nil {
+		log.Printf("ERROR: impersonate: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := a.SessionService.Create(r.Context(), models.NewSession{
+		UserID:         user.ID,
+		UserAgent:      r.UserAgent(),
+		IPAddress:      clientIP(r),
+		ImpersonatorID: &admin.ID,
+	})
+	if err != nil {
+		log.Printf("ERROR: impersonate: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	err = a.AuditService.Record(r.Context(), newAuditEvent(r, models.AuditImpersonationStart, &admin.ID, &user.ID,
+		map[string]any{"session_id": session.ID}))
+	if err != nil {
+		log.Printf("ERROR: impersonate: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	setCookieUntil(w, CookieImpersonatorName, adminToken, a.SessionService.CookieExpiresAt(adminSession))
+	setCookieUntil(w, CookieSessionName, session.Token, a.SessionService.CookieExpiresAt(session))
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// StopImpersonation ends the session of the impersonation and signs the admin
+// back in.
+func (a *Admin) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	admin := custctx.Impersonator(r.Context())
+	session := custctx.Session(r.Context())
+	if admin == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	err := a.SessionService.DeleteByID(r.Context(), user.ID, session.ID)
+	if err != nil {
+		log.Printf("ERROR: stop impersonation: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieSessionName)
+
+	err = a.AuditService.Record(r.Context(), newAuditEvent(r, models.AuditImpersonationStop, &admin.ID, &user.ID,
+		map[string]any{"session_id": session.ID}))
+	if err != nil {
+		log.Printf("ERROR: stop impersonation: %v\n", err.Error())
+	}
+
+	adminToken, err := readCookie(r, CookieImpersonatorName)
+	deleteCookie(w, CookieImpersonatorName)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	// Note: the session of the admin might have expired meanwhile.
+	adminUser, adminSession, err := a.SessionService.User(r.Context(), adminToken)
+	if err != nil || adminUser.ID != admin.ID {
+		if err != nil && !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrTokenExpired) {
+			log.Printf("ERROR: stop impersonation: %v\n", err.Error())
+		}
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	setCookieUntil(w, CookieSessionName, adminToken, a.SessionService.CookieExpiresAt(adminSession))
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(user.ID), http.StatusFound)
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+func (u *Users) Invitations(w http.ResponseWriter, r *http.Request) {
+	if !u.UserService.Registration.InviteOnly() {
+		http.NotFound(w, r)
+		return
+	}
+	u.executeInvitations(w, r, "")
+}
+
+func (u *Users) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	if !u.UserService.Registration.InviteOnly() {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := custctx.User(r.Context())
+	invitation, err := u.InvitationService.Create(r.Context(), user)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyInvitations) {
+			err = errors.Public(err, "You have too many unused invitations. Revoke some of them first.")
+		} else {
+			log.Printf("ERROR: create invitation: %v\n", err.Error())
+		}
+		u.executeInvitations(w, r, "", err)
+		return
+	}
+
+	u.executeInvitations(w, r, invitation.Code)
+}
+
+func (u *Users) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("DEBUG: revoke invitation: %v\n", err.Error())
+		http.Error(w, "Invitation is not found", http.StatusNotFound)
+		return
+	}
+
+	user := custctx.User(r.Context())
+	err = u.InvitationService.Delete(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Invitation is not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: revoke invitation: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/invitations", http.StatusFound)
+}
+
+func (u *Users) executeInvitations(w http.ResponseWriter, r *http.Request, newCode string, errs ...error) {
+	user := custctx.User(r.Context())
+
+	invitations, err := u.InvitationService.ByCreator(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: invitations: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Invitations []models.Invitation
+		// NewCode is shown only once, right after it is created.
+		NewCode string
+	}{
+		Invitations: invitations,
+		NewCode:     newCode,
+	}
+	u.Templates.Invitations.Execute(w, r, data, errs...)
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const maxJSONBodySize = 1 << 20 // 1 MB
+
+type jsonError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("ERROR: write json: %v\n", err.Error())
+	}
+}
+
+// writeJSONError writes the error in the same shape for every status. Only
+// the public message of the error is shown, otherwise the text of the status.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, newJSONError(status, err))
+}
+
+func newJSONError(status int, err error) jsonError {
+	var body jsonError
+	body.Error.Status = status
+	body.Error.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	body.Error.Message = http.StatusText(status)
+
+	if msg := publicMessage(err); msg != "" {
+		body.Error.Message = msg
+	}
+	return body
+}
+
+func publicMessage(err error) string {
+	var public interface{ Public() string }
+	if errors.As(err, &public) {
+		return public.Public()
+	}
+	return ""
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return errors.Public(errors.Wrap(err, "read json"), "The request body is not valid JSON: "+err.Error())
+	}
+	return nil
+}
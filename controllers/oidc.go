@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/oidc"
+)
+
+const (
+	oidcFlowDuration = 10 * time.Minute
+
+	// oidcPurposeReauth marks the flows, which only confirm that the signed in
+	// user is the owner of the connected account.
+	oidcPurposeReauth = "reauth"
+)
+
+func (u *Users) StartOIDC(w http.ResponseWriter, r *http.Request) {
+	provider := u.oidcProvider(chi.URLParam(r, "provider"))
+	if provider == nil {
+		http.Error(w, "Provider is not found", http.StatusNotFound)
+		return
+	}
+
+	flow, err := oidc.NewFlow()
+	if err != nil {
+		log.Printf("ERROR: start oidc: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), flow)
+	if err != nil {
+		log.Printf("ERROR: start oidc: %v\n", err.Error())
+		u.failOIDC(w, r, errors.Public(err, "The sign in is not available right now. Please try again later."))
+		return
+	}
+
+	// Note: the invitation code is kept for the case when the sign in creates a new user.
+	purpose := ""
+	if r.FormValue("reauth") == "true" {
+		purpose = oidcPurposeReauth
+	} else if custctx.User(r.Context()) != nil {
+		err = u.confirmLink(r)
+		if err != nil {
+			if !errors.Is(err, models.ErrWrongPw) {
+				log.Printf("ERROR: start oidc: %v\n", err.Error())
+			}
+			u.failOIDC(w, r, err)
+			return
+		}
+	}
+	value := strings.Join([]string{provider.Name, flow.State, flow.Nonce, flow.Verifier, r.FormValue("invite"), purpose}, ".")
+	setCookieUntil(w, CookieOIDCName, value, time.Now().Add(oidcFlowDuration))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (u *Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider := u.oidcProvider(chi.URLParam(r, "provider"))
+	if provider == nil {
+		http.Error(w, "Provider is not found", http.StatusNotFound)
+		return
+	}
+
+	value, err := readCookie(r, CookieOIDCName)
+	deleteCookie(w, CookieOIDCName)
+	parts := strings.Split(value, ".")
+	// Note: the state must match, otherwise anybody could sign in the user into another account.
+	if err != nil || len(parts) != 6 || parts[0] != provider.Name || parts[1] != r.FormValue("state") {
+		u.failOIDC(w, r, errors.Public(errors.New("oidc state mismatch", "provider", provider.Name), "The sign in has failed. Please try again."))
+		return
+	}
+	if r.FormValue("error") != "" {
+		u.failOIDC(w, r, errors.Public(errors.New("oidc error", "error", r.FormValue("error")), "The sign in was cancelled."))
+		return
+	}
+	// Note: the external account of the admin must not be connected to the impersonated user.
+	if custctx.Impersonator(r.Context()) != nil {
+		u.failOIDC(w, r, errors.Public(errors.New("oidc callback while impersonating", "provider", provider.Name),
+			"The external accounts cannot be connected while impersonating."))
+		return
+	}
+
+	flow := oidc.Flow{
+		State:    parts[1],
+		Nonce:    parts[2],
+		Verifier: parts[3],
+	}
+	claims, err := provider.Exchange(r.Context(), r.FormValue("code"), &flow)
+	if err != nil {
+		log.Printf("ERROR: oidc callback: %v\n", err.Error())
+		u.failOIDC(w, r, errors.Public(err, "The sign in has failed. Please try again."))
+		return
+	}
+
+	current := custctx.User(r.Context())
+	if current != nil && parts[5] == oidcPurposeReauth {
+		u.reauthenticate(w, r, provider, claims)
+		return
+	}
+	if current != nil {
+		// Note: a connected account is a new way to sign in, so a stolen session must not be enough to add one.
+		session := custctx.Session(r.Context())
+		if session == nil || !session.Reauthenticated() {
+			u.failOIDC(w, r, errors.Public(errors.New("oidc link: not reauthenticated", "user ID", current.ID),
+				"Confirm it is you before you connect an account."))
+			return
+		}
+
+		err = u.IdentityService.Link(r.Context(), current.ID, provider.Name, claims.Subject, claims.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrIdentityTaken) {
+				err = errors.Public(err, "That account is already connected to another user.")
+			} else {
+				log.Printf("ERROR: oidc callback: %v\n", err.Error())
+			}
+			u.failOIDC(w, r, err)
+			return
+		}
+		recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditIdentityLinked, &current.ID, &current.ID,
+			map[string]any{"provider": provider.Name}))
+		http.Redirect(w, r, "/users/me?updated=identity", http.StatusFound)
+		return
+	}
+
+	user, err := u.oidcUser(r.Context(), provider, claims, parts[4])
+	if err != nil {
+		var public interface{ Public() string }
+		if !errors.As(err, &public) {
+			log.Printf("ERROR: oidc callback: %v\n", err.Error())
+		}
+		u.failOIDC(w, r, err)
+		return
+	}
+
+	u.completeSignIn(w, r, user, false)
+}
+
+func (u *Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("DEBUG: unlink identity: %v\n", err.Error())
+		http.Error(w, "Identity is not found", http.StatusNotFound)
+		return
+	}
+
+	user := custctx.User(r.Context())
+	err = u.IdentityService.Unlink(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Identity is not found", http.StatusNotFound)
+			return
+		case errors.Is(err, models.ErrLastSignInMethod):
+			err = errors.Public(err, "You could not sign in without this account. Set a password first via the forgot password page.")
+		default:
+			log.Printf("ERROR: unlink identity: %v\n", err.Error())
+		}
+		u.executeAccount(w, r, err)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditIdentityUnlinked, &user.ID, &user.ID,
+		map[string]any{"identity_id": id}))
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// reauthenticate lets the users without password do the sensitive changes for
+// a while, if the external identity is theirs.
+func (u *Users) reauthenticate(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, claims *oidc.Claims) {
+	current := custctx.User(r.Context())
+	session := custctx.Session(r.Context())
+
+	owner, err := u.IdentityService.User(r.Context(), provider.Name, claims.Subject)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Printf("ERROR: oidc reauthenticate: %v\n", err.Error())
+		u.failOIDC(w, r, err)
+		return
+	}
+	if err != nil || owner.ID != current.ID || session == nil {
+		u.failOIDC(w, r, errors.Public(errors.New("oidc reauthenticate: foreign identity", "provider", provider.Name),
+			"That account is not connected to yours."))
+		return
+	}
+
+	err = u.SessionService.Reauthenticate(r.Context(), session.ID)
+	if err != nil {
+		log.Printf("ERROR: oidc reauthenticate: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me?updated=reauth", http.StatusFound)
+}
+
+// confirmLink checks the password of the user, who connects an account, and
+// marks the session reauthenticated, because the callback accepts the link only
+// from such a session. The users without password must have reauthenticated
+// already.
+func (u *Users) confirmLink(r *http.Request) error {
+	err := u.confirmIdentity(r)
+	if err != nil {
+		return errors.Wrap(err, "confirm link")
+	}
+
+	session := custctx.Session(r.Context())
+	if session == nil {
+		return errors.New("confirm link: no session")
+	}
+	err = u.SessionService.Reauthenticate(r.Context(), session.ID)
+	if err != nil {
+		return errors.Wrap(err, "confirm link")
+	}
+	return nil
+}
+
+// oidcUser finds the user of the external identity. If there is none, the
+// identity is linked to the account with the same verified email, or a new
+// account is created.
+func (u *Users) oidcUser(ctx context.Context, provider *oidc.Provider, claims *oidc.Claims, invitationCode string) (*models.User, error) {
+	user, err := u.IdentityService.User(ctx, provider.Name, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, models.ErrNotFound) {
+		return nil, errors.Wrap(err, "oidc user")
+	}
+
+	if claims.Email == "" {
+		return nil, errors.Public(errors.New("oidc user: no email", "provider", provider.Name),
+			"The provider did not share your email address.")
+	}
+
+	user, err = u.IdentityService.UserByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		// Note: both sides must have verified the email, otherwise whoever registered it first could take over the account.
+		if !bool(claims.EmailVerified) || !user.EmailVerified() {
+			return nil, errors.Public(errors.Wrap(models.ErrEmailTaken, "oidc user"),
+				"An account with this email address already exists. Sign in with your password and connect the provider on the account settings page.")
+		}
+		err = u.IdentityService.Link(ctx, user.ID, provider.Name, claims.Subject, claims.Email)
+		if err != nil {
+			return nil, errors.Wrap(err, "oidc user")
+		}
+		return user, nil
+	case !errors.Is(err, models.ErrNotFound):
+		return nil, errors.Wrap(err, "oidc user")
+	}
+
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	user, err = u.IdentityService.CreateUser(ctx, models.NewIdentityUser{
+		Name:           name,
+		Email:          claims.Email,
+		EmailVerified:  bool(claims.EmailVerified),
+		Provider:       provider.Name,
+		Subject:        claims.Subject,
+		InvitationCode: invitationCode,
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			err = errors.Public(err, "An account with this email address already exists.")
+		} else {
+			err = u.registrationError(err)
+		}
+		return nil, errors.Wrap(err, "oidc user")
+	}
+
+	if !user.EmailVerified() {
+		err = u.sendVerification(ctx, user)
+		if err != nil {
+			log.Printf("ERROR: oidc user: %v\n", err.Error())
+		}
+	}
+	return user, nil
+}
+
+func (u *Users) failOIDC(w http.ResponseWriter, r *http.Request, err error) {
+	if custctx.User(r.Context()) != nil {
+		u.executeAccount(w, r, err)
+		return
+	}
+	u.signInFailed(w, r, err)
+}
+
+func (u *Users) oidcProvider(name string) *oidc.Provider {
+	for _, provider := range u.OIDCProviders {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return nil
+}
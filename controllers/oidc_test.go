@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/oidc"
+	"github.com/szykes/simple-backend/oidc/oidctest"
+)
+
+// recordingTemplate keeps the errors it was executed with.
+type recordingTemplate struct {
+	errs []error
+}
+
+func (t *recordingTemplate) Execute(w http.ResponseWriter, r *http.Request, data any, errs ...error) {
+	t.errs = append(t.errs, errs...)
+}
+
+func (t *recordingTemplate) public() string {
+	for _, err := range t.errs {
+		var public interface{ Public() string }
+		if errors.As(err, &public) {
+			return public.Public()
+		}
+	}
+	return ""
+}
+
+func newOIDCTest(t *testing.T) (*oidctest.Server, *recordingTemplate, http.Handler) {
+	s := oidctest.NewServer(t, oidctest.NewRSAKey(t, "key-1"))
+	signIn := &recordingTemplate{}
+	u := Users{
+		OIDCProviders: []*oidc.Provider{{
+			Name:         "stub",
+			DisplayName:  "Stub",
+			Issuer:       s.URL,
+			ClientID:     oidctest.ClientID,
+			ClientSecret: oidctest.ClientSecret,
+			RedirectURL:  oidctest.RedirectURL,
+			Client:       s.Client(),
+		}},
+	}
+	u.Templates.SignIn = signIn
+
+	r := chi.NewRouter()
+	r.Post("/oauth/{provider}", u.StartOIDC)
+	r.Get("/oauth/{provider}/callback", u.OIDCCallback)
+	return s, signIn, r
+}
+
+// startOIDC starts the flow and returns the cookie of it and the redirect of
+// the provider back to the app.
+func startOIDC(t *testing.T, s *oidctest.Server, h http.Handler) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/oauth/stub", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start status = %d, want %d", rec.Code, http.StatusFound)
+	}
+
+	var flowCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == CookieOIDCName {
+			flowCookie = cookie
+		}
+	}
+	if flowCookie == nil {
+		t.Fatal("no flow cookie")
+	}
+	return flowCookie, s.Authorize(t, rec.Header().Get("Location"))
+}
+
+func callback(h http.Handler, flowCookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/oauth/stub/callback?"+query.Encode(), nil)
+	if flowCookie != nil {
+		req.AddCookie(flowCookie)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStartOIDC(t *testing.T) {
+	s, _, h := newOIDCTest(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/oauth/stub", nil))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("location: %v", err)
+	}
+	if !strings.HasPrefix(location.String(), s.URL+"/authorize?") {
+		t.Fatalf("location = %q, want the authorization endpoint", location)
+	}
+	if location.Query().Get("code_challenge_method") != "S256" || location.Query().Get("code_challenge") == "" {
+		t.Errorf("query = %v, want a PKCE challenge", location.Query())
+	}
+
+	flowCookie, redirect := startOIDC(t, s, h)
+	parts := strings.Split(flowCookie.Value, ".")
+	if len(parts) != 6 || parts[0] != "stub" || parts[1] != redirect.Get("state") {
+		t.Errorf("flow cookie = %q, state = %q", flowCookie.Value, redirect.Get("state"))
+	}
+	if !flowCookie.HttpOnly {
+		t.Error("flow cookie is readable by scripts")
+	}
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	s, signIn, h := newOIDCTest(t)
+	flowCookie, redirect := startOIDC(t, s, h)
+
+	redirect.Set("state", "forged-state")
+	callback(h, flowCookie, redirect)
+	if got, want := signIn.public(), "The sign in has failed. Please try again."; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestOIDCCallbackWithoutCookie(t *testing.T) {
+	s, signIn, h := newOIDCTest(t)
+	_, redirect := startOIDC(t, s, h)
+
+	callback(h, nil, redirect)
+	if got, want := signIn.public(), "The sign in has failed. Please try again."; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestOIDCCallbackCancelled(t *testing.T) {
+	s, signIn, h := newOIDCTest(t)
+	flowCookie, redirect := startOIDC(t, s, h)
+
+	redirect.Set("error", "access_denied")
+	redirect.Del("code")
+	callback(h, flowCookie, redirect)
+	if got, want := signIn.public(), "The sign in was cancelled."; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestOIDCCallbackInvalidToken(t *testing.T) {
+	s, signIn, h := newOIDCTest(t)
+	forged := oidctest.NewRSAKey(t, "key-1")
+	s.IDToken = func(nonce string) string {
+		return forged.Sign(t, s.Claims(nonce))
+	}
+	flowCookie, redirect := startOIDC(t, s, h)
+
+	rec := callback(h, flowCookie, redirect)
+	if got, want := signIn.public(), "The sign in has failed. Please try again."; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+	if !errors.Is(signIn.errs[0], oidc.ErrInvalidToken) {
+		t.Errorf("error = %v, want %v", signIn.errs[0], oidc.ErrInvalidToken)
+	}
+
+	// Note: the flow cookie is deleted, so the state cannot be used again.
+	deleted := false
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == CookieOIDCName && cookie.MaxAge < 0 {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Error("flow cookie is kept")
+	}
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+type signInLinkData struct {
+	Email string
+	Token string
+	Sent  bool
+}
+
+// SignInLink shows the form to ask for a link, or the button to use the link.
+// Note: the link itself only shows the button, so the mail scanners opening
+// the links do not use up the token.
+func (u *Users) SignInLink(w http.ResponseWriter, r *http.Request) {
+	data := signInLinkData{
+		Email: r.FormValue("email"),
+		Token: r.FormValue("token"),
+	}
+	u.Templates.SignInLink.Execute(w, r, data)
+}
+
+func (u *Users) DoSignInLink(w http.ResponseWriter, r *http.Request) {
+	data := signInLinkData{
+		Email: r.FormValue("email"),
+	}
+
+	err := u.emailToken(r, models.AttemptSignInLink, data.Email, "Too many sign in link requests. Please try again later.",
+		func(ctx context.Context, email string) (string, error) {
+			link, err := u.SignInLinkService.Create(ctx, email)
+			if err != nil {
+				return "", err
+			}
+			return link.Token, nil
+		}, u.EmailService.SignInLink)
+	if err != nil {
+		if publicMessage(err) == "" {
+			log.Printf("ERROR: do sign in link: %v\n", err.Error())
+		}
+		u.Templates.SignInLink.Execute(w, r, data, err)
+		return
+	}
+
+	data.Sent = true
+	u.Templates.SignInLink.Execute(w, r, data)
+}
+
+func (u *Users) ConsumeSignInLink(w http.ResponseWriter, r *http.Request) {
+	user, err := u.SignInLinkService.Consume(r.Context(), r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "The sign in link is invalid or expired. Please ask for a new one.")
+		} else {
+			log.Printf("ERROR: consume sign in link: %v\n", err.Error())
+		}
+		u.Templates.SignInLink.Execute(w, r, signInLinkData{}, err)
+		return
+	}
+
+	u.completeSignIn(w, r, user, false)
+}
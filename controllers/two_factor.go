@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/szykes/simple-backend/custctx"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/models"
+)
+
+type twoFactorData struct {
+	Enabled        bool
+	Secret         string
+	URI            string
+	RecoveryCodes  []string
+	RemainingCodes int
+}
+
+func (u *Users) TwoFactorCode(w http.ResponseWriter, r *http.Request) {
+	_, err := readCookie(r, CookieTwoFactorName)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactorCode.Execute(w, r, nil)
+}
+
+func (u *Users) DoTwoFactorCode(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieTwoFactorName)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	// Note: the failures are counted for the account too, so the code cannot be guessed from many IP addresses.
+	user, err := u.twoFactorUser(r, token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			deleteCookie(w, CookieTwoFactorName)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		log.Printf("ERROR: do two factor code: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	account := user.Email
+
+	ip := clientIP(r)
+	err = u.AttemptService.Check(r.Context(), models.AttemptSignIn, ip, account)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAttempts) {
+			err = errors.Public(err, "Too many failed attempts. Please try again later.")
+		} else {
+			log.Printf("ERROR: do two factor code: %v\n", err.Error())
+		}
+		u.Templates.TwoFactorCode.Execute(w, r, nil, err)
+		return
+	}
+
+	challenge, err := u.TwoFactorService.CompleteChallenge(r.Context(), token, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCode):
+			failErr := u.AttemptService.Fail(r.Context(), models.AttemptSignIn, ip, account)
+			if failErr != nil {
+				log.Printf("ERROR: do two factor code: %v\n", failErr.Error())
+			}
+			recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditSignInFailed, nil, nil, map[string]any{"reason": "2fa"}))
+			err = errors.Public(err, "The code is not valid. Try again.")
+			u.Templates.TwoFactorCode.Execute(w, r, nil, err)
+		case errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired):
+			deleteCookie(w, CookieTwoFactorName)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+		default:
+			log.Printf("ERROR: do two factor code: %v\n", err.Error())
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	deleteCookie(w, CookieTwoFactorName)
+	err = u.AttemptService.Reset(r.Context(), models.AttemptSignIn, account)
+	if err != nil {
+		log.Printf("ERROR: do two factor code: %v\n", err.Error())
+	}
+
+	err = u.startSession(w, r, user, challenge.Remember)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountDisabled):
+			u.signInFailed(w, r, errors.Public(err, "The account is disabled."))
+			return
+		case errors.Is(err, models.ErrNotFound):
+			u.signInFailed(w, r, errors.Public(err, "The account is deleted."))
+			return
+		}
+		log.Printf("ERROR: do two factor code: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	data := twoFactorData{
+		Enabled: user.TwoFactorEnabled(),
+	}
+
+	if data.Enabled {
+		remaining, err := u.TwoFactorService.RemainingRecoveryCodes(r.Context(), user.ID)
+		if err != nil {
+			log.Printf("ERROR: two factor: %v\n", err.Error())
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		data.RemainingCodes = remaining
+	}
+
+	u.Templates.TwoFactor.Execute(w, r, data)
+}
+
+func (u *Users) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	secret, err := u.TwoFactorService.Enroll(r.Context(), user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+			return
+		}
+		log.Printf("ERROR: enroll two factor: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	data := twoFactorData{
+		Secret: secret,
+		URI:    u.TwoFactorService.URI(user.Email, secret),
+	}
+	u.Templates.TwoFactor.Execute(w, r, data)
+}
+
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	codes, err := u.TwoFactorService.Enable(r.Context(), user.ID, r.FormValue("code"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCode) {
+			log.Printf("ERROR: enable two factor: %v\n", err.Error())
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+			return
+		}
+
+		secret, secretErr := u.TwoFactorService.Enrollment(r.Context(), user.ID)
+		if secretErr != nil {
+			log.Printf("ERROR: enable two factor: %v\n", secretErr.Error())
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+			return
+		}
+		data := twoFactorData{
+			Secret: secret,
+			URI:    u.TwoFactorService.URI(user.Email, secret),
+		}
+		err = errors.Public(err, "The code is not valid. Check the time of your device and try again.")
+		u.Templates.TwoFactor.Execute(w, r, data, err)
+		return
+	}
+
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditTwoFactorEnabled, &user.ID, &user.ID, nil))
+
+	data := twoFactorData{
+		Enabled:        true,
+		RecoveryCodes:  codes,
+		RemainingCodes: len(codes),
+	}
+	u.Templates.TwoFactor.Execute(w, r, data)
+}
+
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, r.FormValue("password"))
+	if err != nil {
+		log.Printf("DEBUG: disable two factor: %v\n", err.Error())
+		data := twoFactorData{
+			Enabled: user.TwoFactorEnabled(),
+		}
+		err = errors.Public(err, "Wrong password")
+		u.Templates.TwoFactor.Execute(w, r, data, err)
+		return
+	}
+
+	err = u.TwoFactorService.Disable(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("ERROR: disable two factor: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditTwoFactorDisabled, &user.ID, &user.ID, nil))
+
+	http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+}
+
+// twoFactorUser is the user of the challenge, the failed attempts of the sign
+// in are counted by the email of it.
+func (u *Users) twoFactorUser(r *http.Request, token string) (*models.User, error) {
+	challenge, err := u.TwoFactorService.Challenge(r.Context(), token)
+	if err != nil {
+		return nil, errors.Wrap(err, "two factor user")
+	}
+	user, err := u.UserService.ByID(r.Context(), challenge.UserID)
+	if err != nil {
+		return nil, errors.Wrap(err, "two factor user", "user ID", challenge.UserID)
+	}
+	return user, nil
+}
@@ -1,13 +1,21 @@
 package controllers
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/csrf"
 	"github.com/szykes/simple-backend/custctx"
 	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/mailer"
 	"github.com/szykes/simple-backend/models"
+	"github.com/szykes/simple-backend/oidc"
+	"github.com/szykes/simple-backend/password"
 )
 
 type Users struct {
@@ -17,20 +25,47 @@ type Users struct {
 		ForgotPassword template
 		CheckYourEmail template
 		ResetPassword  template
+		VerifyEmail    template
+		Sessions       template
+		TwoFactor      template
+		TwoFactorCode  template
+		Account        template
+		ConfirmEmail   template
+		AccountDeleted template
+		SignInLink     template
+		Activity       template
+		AccessTokens   template
+		Invitations    template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	SignInLinkService        *models.SignInLinkService
+	EmailVerificationService *models.EmailVerificationService
+	EmailChangeService       *models.EmailChangeService
+	TwoFactorService         *models.TwoFactorService
+	AttemptService           *models.AttemptService
+	AccountDeletionService   *models.AccountDeletionService
+	DataExportService        *models.DataExportService
+	IdentityService          *models.IdentityService
+	AuditService             *models.AuditService
+	AccessTokenService       *models.AccessTokenService
+	InvitationService        *models.InvitationService
+	OIDCProviders            []*oidc.Provider
+	EmailService             *mailer.Service
+}
+
+type signUpData struct {
+	Name           string
+	Email          string
+	InvitationCode string
+	Closed         bool
+	InviteOnly     bool
+	Providers      []*oidc.Provider
 }
 
 func (u *Users) New(w http.ResponseWriter, r *http.Request) {
-	data := struct {
-		Name  string
-		Email string
-	}{
-		Name:  r.FormValue("name"),
-		Email: r.FormValue("email"),
-	}
+	data := u.signUpData(r.FormValue("name"), r.FormValue("email"), r.FormValue("invite"))
 	u.Templates.New.Execute(w, r, data)
 }
 
@@ -40,54 +75,101 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Email:           r.FormValue("email"),
 		Password:        r.FormValue("password"),
 		ConfirmPassword: r.FormValue("confirmPassword"),
+		InvitationCode:  r.FormValue("invite"),
 	}
 	user, err := u.UserService.Create(r.Context(), newUser)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrEmailTaken):
 			err = errors.Public(err, "That email address is already associated with an account.")
+		case errors.Is(err, models.ErrEmailInvalid):
+			err = errors.Public(err, "The email address is not valid.")
 		case errors.Is(err, models.ErrPwMismatch):
 			err = errors.Public(err, "The given passwords do not match.")
+		case errors.Is(err, password.ErrPolicy):
+			// Note: the policy errors are public already.
+		case errors.Is(err, models.ErrRegistrationClosed) || errors.Is(err, models.ErrDomainNotAllowed) ||
+			errors.Is(err, models.ErrInvalidInvitation):
+			err = u.registrationError(err)
 		default:
 			log.Printf("ERROR: create user: %v\n", err.Error())
 		}
-		u.Templates.New.Execute(w, r, newUser, err)
+		data := u.signUpData(newUser.Name, newUser.Email, newUser.InvitationCode)
+		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditSignUp, &user.ID, &user.ID, nil))
 
-	session, err := u.SessionService.Create(r.Context(), user.ID)
+	err = u.sendVerification(r.Context(), user)
+	if err != nil {
+		log.Printf("ERROR: create user: %v\n", err.Error())
+	}
+
+	err = u.startSession(w, r, user, false)
 	if err != nil {
 		log.Printf("DEBUG: create user: %v\n", err.Error())
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 
-	setCookie(w, CookieSessionName, session.Token)
-
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+func (u *Users) signUpData(name, email, invitationCode string) signUpData {
+	return signUpData{
+		Name:           name,
+		Email:          email,
+		InvitationCode: invitationCode,
+		Closed:         u.UserService.Registration.Closed(),
+		InviteOnly:     u.UserService.Registration.InviteOnly(),
+		Providers:      u.OIDCProviders,
+	}
+}
+
+// registrationError explains why the registration policy did not let the user
+// in. The other errors are returned as they are.
+func (u *Users) registrationError(err error) error {
+	switch {
+	case errors.Is(err, models.ErrRegistrationClosed):
+		return errors.Public(err, "Sign up is closed at the moment.")
+	case errors.Is(err, models.ErrDomainNotAllowed):
+		domains := strings.Join(u.UserService.Registration.AllowedDomains, ", ")
+		return errors.Public(err, "Only email addresses of the following domains can sign up: "+domains+".")
+	case errors.Is(err, models.ErrInvalidInvitation):
+		return errors.Public(err, "Sign up needs a valid invitation code. The code is invalid, expired or used already.")
+	}
+	return err
+}
+
 func (u *Users) SignIn(w http.ResponseWriter, r *http.Request) {
 	data := struct {
-		Email string
+		Email     string
+		Remember  bool
+		Providers []*oidc.Provider
 	}{
-		Email: r.FormValue("email"),
+		Email:     r.FormValue("email"),
+		Providers: u.OIDCProviders,
 	}
 	u.Templates.SignIn.Execute(w, r, data)
 }
 
 func (u *Users) DoSignIn(w http.ResponseWriter, r *http.Request) {
 	data := struct {
-		Email    string
-		Password string
+		Email     string
+		Password  string
+		Remember  bool
+		Providers []*oidc.Provider
 	}{
-		Email:    r.FormValue("email"),
-		Password: r.FormValue("password"),
+		Email:     r.FormValue("email"),
+		Password:  r.FormValue("password"),
+		Remember:  r.FormValue("remember") == "true",
+		Providers: u.OIDCProviders,
 	}
-	user, err := u.UserService.Authenticate(r.Context(), data.Email, data.Password)
+	ip := clientIP(r)
+	err := u.AttemptService.Check(r.Context(), models.AttemptSignIn, ip, data.Email)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			err = errors.Public(err, "Wrong email and/or password")
+		if errors.Is(err, models.ErrTooManyAttempts) {
+			err = errors.Public(err, "Too many failed attempts. Please try again later.")
 		} else {
 			log.Printf("ERROR: do sign in: %v\n", err.Error())
 		}
@@ -95,23 +177,33 @@ func (u *Users) DoSignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := u.SessionService.Create(r.Context(), user.ID)
+	user, err := u.UserService.Authenticate(r.Context(), data.Email, data.Password)
 	if err != nil {
-		log.Printf("ERROR: do sign in: %v\n", err.Error())
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrWrongPw) {
+			failErr := u.AttemptService.Fail(r.Context(), models.AttemptSignIn, ip, data.Email)
+			if failErr != nil {
+				log.Printf("ERROR: do sign in: %v\n", failErr.Error())
+			}
+			event := newAuditEvent(r, models.AuditSignInFailed, nil, nil, map[string]any{"email": data.Email, "reason": "password"})
+			event.TargetEmail = data.Email
+			recordAudit(r, u.AuditService, event)
+			err = errors.Public(err, "Wrong email and/or password")
+		} else {
+			log.Printf("ERROR: do sign in: %v\n", err.Error())
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
 		return
 	}
 
-	setCookie(w, CookieSessionName, session.Token)
-
-	http.Redirect(w, r, "/galleries", http.StatusFound)
-}
-
-func (u *Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := custctx.User(ctx)
+	// Note: the failures are forgotten only after the second factor, otherwise the password would reset the guesses of the code.
+	if !user.TwoFactorEnabled() {
+		err = u.AttemptService.Reset(r.Context(), models.AttemptSignIn, data.Email)
+		if err != nil {
+			log.Printf("ERROR: do sign in: %v\n", err.Error())
+		}
+	}
 
-	fmt.Fprintf(w, "Current user: %s", user.Email)
+	u.completeSignIn(w, r, user, data.Remember)
 }
 
 func (u *Users) DoSignOut(w http.ResponseWriter, r *http.Request) {
@@ -128,6 +220,9 @@ func (u *Users) DoSignOut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	if user := custctx.User(r.Context()); user != nil {
+		recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditSignOut, auditActorID(r), &user.ID, nil))
+	}
 
 	deleteCookie(w, CookieSessionName)
 	http.Redirect(w, r, "/signin", http.StatusFound)
@@ -144,28 +239,68 @@ func (u *Users) ForgetPassword(w http.ResponseWriter, r *http.Request) {
 
 func (u *Users) DoForgetPassword(w http.ResponseWriter, r *http.Request) {
 	data := struct {
-		Email     string
-		ResetLink string
+		Email string
 	}{
 		Email: r.FormValue("email"),
 	}
-	pwReset, err := u.PasswordResetService.Create(r.Context(), data.Email)
+
+	err := u.emailToken(r, models.AttemptForgotPassword, data.Email, "Too many password reset requests. Please try again later.",
+		func(ctx context.Context, email string) (string, error) {
+			pwReset, err := u.PasswordResetService.Create(ctx, email)
+			if err != nil {
+				return "", err
+			}
+			recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditPasswordResetRequested, nil, &pwReset.UserID, nil))
+			return pwReset.Token, nil
+		}, u.EmailService.ForgotPassword)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			err = errors.Public(err, "Wrong email")
-		} else {
+		if publicMessage(err) == "" {
 			log.Printf("ERROR: do forgot password: %v\n", err.Error())
 		}
 		u.Templates.ForgotPassword.Execute(w, r, data, err)
 		return
 	}
 
-	data.ResetLink = "http://localhost:3000/reset-password?token=" + pwReset.Token
-	// TODO: here should be the emailing part
-
 	u.Templates.CheckYourEmail.Execute(w, r, data)
 }
 
+// emailToken creates a token by create and emails it by send, e.g. a password
+// reset or a sign in link. The requests are limited by the attempts of the
+// action, and every request counts, not just the failed ones, because each of
+// them sends an email. An unknown email is not an error, so the response does
+// not tell whether the email exists.
+func (u *Users) emailToken(r *http.Request, action, email, tooMany string,
+	create func(ctx context.Context, email string) (string, error),
+	send func(ctx context.Context, email, token string) error) error {
+	ip := clientIP(r)
+	err := u.AttemptService.Check(r.Context(), action, ip, email)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyAttempts) {
+			return errors.Public(err, tooMany)
+		}
+		return errors.Wrap(err, "email token", "action", action)
+	}
+
+	err = u.AttemptService.Fail(r.Context(), action, ip, email)
+	if err != nil {
+		log.Printf("ERROR: email token: %v\n", err.Error())
+	}
+
+	token, err := create(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "email token", "action", action)
+	}
+
+	err = send(r.Context(), email, token)
+	if err != nil {
+		return errors.Wrap(err, "email token", "action", action)
+	}
+	return nil
+}
+
 func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Token string
@@ -192,7 +327,28 @@ func (u *Users) DoResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.PasswordResetService.Consume(r.Context(), data.Token)
+	user, err := u.PasswordResetService.User(r.Context(), data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "The reset link is invalid or expired. Please ask for a new one.")
+		} else {
+			log.Printf("ERROR: do reset password: %v\n", err.Error())
+		}
+		u.Templates.ResetPassword.Execute(w, r, data, err)
+		return
+	}
+
+	// Note: validating before consuming the token, so the user can try again with another password.
+	err = u.UserService.ValidatePassword(data.Password, user.Email)
+	if err != nil {
+		if !errors.Is(err, password.ErrPolicy) {
+			log.Printf("ERROR: do reset password: %v\n", err.Error())
+		}
+		u.Templates.ResetPassword.Execute(w, r, data, err)
+		return
+	}
+
+	user, err = u.PasswordResetService.Consume(r.Context(), data.Token)
 	if err != nil {
 		log.Printf("ERROR: do reset password: %v\n", err.Error())
 		http.Error(w, "Internal error", http.StatusInternalServerError)
@@ -205,44 +361,322 @@ func (u *Users) DoResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditPasswordReset, &user.ID, &user.ID, nil))
+
+	u.completeSignIn(w, r, user, false)
+}
+
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+	var data struct {
+		Sessions []Session
+	}
 
-	session, err := u.SessionService.Create(r.Context(), user.ID)
+	user := custctx.User(r.Context())
+	current := custctx.Session(r.Context())
+	sessions, err := u.SessionService.ByUserID(r.Context(), user.ID)
 	if err != nil {
-		log.Printf("ERROR: do reset password: %v\n", err.Error())
+		log.Printf("ERROR: sessions: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    current != nil && current.ID == session.ID,
+		})
+	}
+
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+func (u *Users) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("DEBUG: delete session: %v\n", err.Error())
+		http.Error(w, "Session is not found", http.StatusNotFound)
+		return
+	}
+
+	user := custctx.User(r.Context())
+	err = u.SessionService.DeleteByID(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session is not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: delete session: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditSessionDeleted, auditActorID(r), &user.ID,
+		map[string]any{"session_id": id}))
+
+	current := custctx.Session(r.Context())
+	if current != nil && current.ID == id {
+		deleteCookie(w, CookieSessionName)
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 
-	setCookie(w, CookieSessionName, session.Token)
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+func (u *Users) DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	current := custctx.Session(r.Context())
+
+	err := u.SessionService.DeleteOthers(r.Context(), user.ID, current.ID)
+	if err != nil {
+		log.Printf("ERROR: delete other sessions: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditOtherSessionsDeleted, auditActorID(r), &user.ID, nil))
+
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// completeSignIn starts the session of an authenticated user, or asks for the
+// second factor first if the user enabled it.
+func (u *Users) completeSignIn(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) {
+	if user.Deleted() && time.Now().After(u.AccountDeletionService.PurgeAt(*user.DeletedAt)) {
+		u.signInFailed(w, r, errors.Public(models.ErrNotFound, "The account is deleted."))
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		challenge, err := u.TwoFactorService.CreateChallenge(r.Context(), user.ID, remember)
+		if err != nil {
+			log.Printf("ERROR: complete sign in: %v\n", err.Error())
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		setCookieUntil(w, CookieTwoFactorName, challenge.Token, challenge.ExpiresAt)
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+
+	err := u.startSession(w, r, user, remember)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountDisabled):
+			u.signInFailed(w, r, errors.Public(err, "The account is disabled."))
+			return
+		case errors.Is(err, models.ErrNotFound):
+			u.signInFailed(w, r, errors.Public(err, "The account is deleted."))
+			return
+		}
+		log.Printf("ERROR: complete sign in: %v\n", err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+// signInFailed shows the sign in page with the error.
+func (u *Users) signInFailed(w http.ResponseWriter, r *http.Request, err error) {
+	data := struct {
+		Email     string
+		Remember  bool
+		Providers []*oidc.Provider
+	}{
+		Providers: u.OIDCProviders,
+	}
+	u.Templates.SignIn.Execute(w, r, data, err)
+}
+
+func (u *Users) startSession(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) error {
+	userID := user.ID
+	session, err := u.SessionService.Create(r.Context(), models.NewSession{
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+		Remember:  remember,
+	})
+	if err != nil {
+		return errors.Wrap(err, "start session", "user ID", userID)
+	}
+
+	if user.Deleted() {
+		// Note: signing in during the grace period cancels the deletion, but only once the session is started, so
+		// the password alone does not restore the account of a user with two-factor authentication.
+		err = u.AccountDeletionService.Restore(r.Context(), userID)
+		if err != nil {
+			deleteErr := u.SessionService.Delete(r.Context(), session.Token)
+			if deleteErr != nil {
+				log.Printf("ERROR: start session: %v\n", deleteErr.Error())
+			}
+			return errors.Wrap(err, "start session", "user ID", userID)
+		}
+	}
+	recordAudit(r, u.AuditService, newAuditEvent(r, models.AuditSignIn, &userID, &userID,
+		map[string]any{"session_id": session.ID, "remember": remember}))
+
+	setCookieUntil(w, CookieSessionName, session.Token, u.SessionService.CookieExpiresAt(session))
+	return nil
+}
+
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Sent bool
+	}{}
+
+	token := r.FormValue("token")
+	if token == "" {
+		user := custctx.User(r.Context())
+		if user != nil && user.EmailVerified() {
+			http.Redirect(w, r, "/galleries", http.StatusFound)
+			return
+		}
+		u.Templates.VerifyEmail.Execute(w, r, data)
+		return
+	}
+
+	_, err := u.EmailVerificationService.Consume(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "The verification link is invalid or expired. Sign in to ask for a new one.")
+		} else {
+			log.Printf("ERROR: verify email: %v\n", err.Error())
+		}
+		u.Templates.VerifyEmail.Execute(w, r, data, err)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := custctx.User(r.Context())
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	data := struct {
+		Sent bool
+	}{}
+
+	err := u.sendVerification(r.Context(), user)
+	if err != nil {
+		log.Printf("ERROR: resend verification: %v\n", err.Error())
+		u.Templates.VerifyEmail.Execute(w, r, data, err)
+		return
+	}
+
+	data.Sent = true
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u *Users) sendVerification(ctx context.Context, user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(ctx, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "send verification", "user ID", user.ID)
+	}
+
+	err = u.EmailService.VerifyEmail(ctx, user.Email, verification.Token)
+	if err != nil {
+		return errors.Wrap(err, "send verification", "user ID", user.ID)
+	}
+	return nil
+}
+
 type UserMiddleware struct {
-	SessionService *models.SessionService
+	SessionService     *models.SessionService
+	AccessTokenService *models.AccessTokenService
 }
 
 func (u *UserMiddleware) SetUser(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			u.setAccessToken(w, r, handler, authorization)
+			return
+		}
+
 		token, err := readCookie(r, CookieSessionName)
 		if err != nil {
 			handler.ServeHTTP(w, r)
 			return
 		}
 
-		user, err := u.SessionService.User(r.Context(), token)
+		user, session, err := u.SessionService.User(r.Context(), token)
 		if err != nil {
-			log.Printf("ERROR: set user: %v\n", err.Error())
+			if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrTokenExpired) {
+				deleteCookie(w, CookieSessionName)
+			} else {
+				log.Printf("ERROR: set user: %v\n", err.Error())
+			}
 			handler.ServeHTTP(w, r)
 			return
 		}
 
+		// Note: the impersonation ends if the admin lost the role meanwhile.
+		if session.Impersonated() && !session.Impersonator.HasRole(models.RoleAdmin) {
+			err = u.SessionService.Delete(r.Context(), token)
+			if err != nil {
+				log.Printf("ERROR: set user: %v\n", err.Error())
+			}
+			deleteCookie(w, CookieSessionName)
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		setCookieUntil(w, CookieSessionName, token, u.SessionService.CookieExpiresAt(session))
+
 		ctx := r.Context()
 		ctx = custctx.WithUser(ctx, user)
+		ctx = custctx.WithSession(ctx, session)
+		if session.Impersonated() {
+			ctx = custctx.WithImpersonator(ctx, session.Impersonator)
+		}
 		r = r.WithContext(ctx)
 		handler.ServeHTTP(w, r)
 	})
 }
 
+// setAccessToken authenticates the scripts by the Bearer access token. The
+// cookies are ignored and the CSRF check is skipped, because the browsers do
+// not send the header by themselves. The errors are JSON, since only the
+// scripts send the header.
+func (u *UserMiddleware) setAccessToken(w http.ResponseWriter, r *http.Request, handler http.Handler, authorization string) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, errors.Public(nil, "Only Bearer access tokens are accepted."))
+		return
+	}
+
+	_, accessToken, err := u.AccessTokenService.User(r.Context(), token, clientIP(r))
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrTokenExpired) {
+			log.Printf("ERROR: set access token: %v\n", err.Error())
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSONError(w, http.StatusUnauthorized, errors.Public(err, "The access token is invalid or expired."))
+		return
+	}
+
+	r = r.WithContext(custctx.WithAccessToken(r.Context(), accessToken))
+	handler.ServeHTTP(w, csrf.UnsafeSkipCheck(r))
+}
+
 func (u *UserMiddleware) RequireUser(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := custctx.User(r.Context())
@@ -253,3 +687,71 @@ func (u *UserMiddleware) RequireUser(handler http.Handler) http.Handler {
 		handler.ServeHTTP(w, r)
 	})
 }
+
+func (u *UserMiddleware) RequireVerifiedUser(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := custctx.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.EmailVerified() {
+			http.Redirect(w, r, "/verify-email", http.StatusFound)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole lets only the signed in users with the role through. The others
+// get 404, so the existence of the page is not revealed.
+func (u *UserMiddleware) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := custctx.User(r.Context())
+			if user == nil {
+				http.Redirect(w, r, "/signin", http.StatusFound)
+				return
+			}
+			if !user.HasRole(role) {
+				http.NotFound(w, r)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DenyImpersonation protects the actions, which only the user may do, e.g.
+// changing the password, from the admins acting on behalf of the user.
+func (u *UserMiddleware) DenyImpersonation(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if custctx.Impersonator(r.Context()) != nil {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope lets the access tokens only with the scope through, and signs
+// in their users. The routes without it do not accept any access token. The
+// sessions are not limited by the scopes.
+func (u *UserMiddleware) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accessToken := custctx.AccessToken(r.Context())
+			if accessToken == nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			if !accessToken.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				writeJSONError(w, http.StatusForbidden, errors.Public(nil, "The access token needs the "+scope+" scope."))
+				return
+			}
+			r = r.WithContext(custctx.WithUser(r.Context(), accessToken.User))
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
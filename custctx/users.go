@@ -10,6 +10,9 @@ type key uint
 
 const (
 	userKey key = iota
+	sessionKey
+	impersonatorKey
+	accessTokenKey
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -23,3 +26,43 @@ func User(ctx context.Context) *models.User {
 	}
 	return user
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	session, ok := ctx.Value(sessionKey).(*models.Session)
+	if !ok {
+		return nil
+	}
+	return session
+}
+
+// WithImpersonator stores the admin, who acts on behalf of the user in the
+// context.
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+func Impersonator(ctx context.Context) *models.User {
+	admin, ok := ctx.Value(impersonatorKey).(*models.User)
+	if !ok {
+		return nil
+	}
+	return admin
+}
+
+// WithAccessToken stores the access token, which authenticated the request.
+// The user is not stored until a route accepts one of the scopes of the token.
+func WithAccessToken(ctx context.Context, accessToken *models.AccessToken) context.Context {
+	return context.WithValue(ctx, accessTokenKey, accessToken)
+}
+
+func AccessToken(ctx context.Context) *models.AccessToken {
+	accessToken, ok := ctx.Value(accessTokenKey).(*models.AccessToken)
+	if !ok {
+		return nil
+	}
+	return accessToken
+}
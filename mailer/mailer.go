@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	Plaintext string
+	HTML      string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+func (m *Message) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	messageID, err := rand.String(16)
+	if err != nil {
+		return nil, errors.Wrap(err, "build message")
+	}
+
+	headers := [][2]string{
+		{"From", m.From},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@simple-backend>", messageID)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+
+	err = writePart(mw, "text/plain; charset=utf-8", m.Plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "build message")
+	}
+	if m.HTML != "" {
+		err = writePart(mw, "text/html; charset=utf-8", m.HTML)
+		if err != nil {
+			return nil, errors.Wrap(err, "build message")
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "build message")
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(mw *multipart.Writer, contentType, body string) error {
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "write part", "content type", contentType)
+	}
+
+	qw := quotedprintable.NewWriter(pw)
+	_, err = qw.Write([]byte(body))
+	if err != nil {
+		return errors.Wrap(err, "write part", "content type", contentType)
+	}
+	return qw.Close()
+}
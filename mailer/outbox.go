@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// Outbox does not deliver anything, it writes the messages in a readable form
+// instead. It is meant for development and tests.
+type Outbox struct {
+	W io.Writer
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+// NewOutbox writes to the stdout if path is empty, otherwise it appends to the
+// given file.
+func NewOutbox(path string) (*Outbox, error) {
+	if path == "" {
+		return &Outbox{W: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "new outbox", "path", path)
+	}
+	return &Outbox{W: file}, nil
+}
+
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, err := fmt.Fprintf(o.W, "----- outbox: %v -----\nFrom: %v\nTo: %v\nSubject: %v\n\n%v\n",
+		time.Now().Format(time.RFC3339), msg.From, msg.To, msg.Subject, msg.Plaintext)
+	if err != nil {
+		return errors.Wrap(err, "outbox send", "to", msg.To)
+	}
+
+	o.sent = append(o.sent, msg)
+	return nil
+}
+
+func (o *Outbox) Sent() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	sent := make([]Message, len(o.sent))
+	copy(sent, o.sent)
+	return sent
+}
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+type Service struct {
+	Mailer    Mailer
+	Templates *Templates
+
+	From    string
+	BaseURL string
+}
+
+func (s *Service) ForgotPassword(ctx context.Context, to, token string) error {
+	data := struct {
+		ResetURL string
+	}{
+		ResetURL: s.url("/reset-password", url.Values{"token": {token}}),
+	}
+
+	err := s.send(ctx, to, "Reset your password", "forgot-password", data)
+	if err != nil {
+		return errors.Wrap(err, "forgot password email")
+	}
+	return nil
+}
+
+func (s *Service) SignInLink(ctx context.Context, to, token string) error {
+	data := struct {
+		SignInURL string
+	}{
+		SignInURL: s.url("/signin/link", url.Values{"token": {token}}),
+	}
+
+	err := s.send(ctx, to, "Your sign in link", "signin-link", data)
+	if err != nil {
+		return errors.Wrap(err, "sign in link email")
+	}
+	return nil
+}
+
+func (s *Service) VerifyEmail(ctx context.Context, to, token string) error {
+	data := struct {
+		VerifyURL string
+	}{
+		VerifyURL: s.url("/verify-email", url.Values{"token": {token}}),
+	}
+
+	err := s.send(ctx, to, "Verify your email address", "verify-email", data)
+	if err != nil {
+		return errors.Wrap(err, "verify email")
+	}
+	return nil
+}
+
+func (s *Service) ConfirmEmailChange(ctx context.Context, to, token string) error {
+	data := struct {
+		ConfirmURL string
+	}{
+		ConfirmURL: s.url("/confirm-email", url.Values{"token": {token}}),
+	}
+
+	err := s.send(ctx, to, "Confirm your new email address", "confirm-email-change", data)
+	if err != nil {
+		return errors.Wrap(err, "confirm email change")
+	}
+	return nil
+}
+
+// EmailChanged notifies the old address, so the owner notices if the account
+// was taken over.
+func (s *Service) EmailChanged(ctx context.Context, to, newEmail string) error {
+	data := struct {
+		NewEmail  string
+		SignInURL string
+	}{
+		NewEmail:  newEmail,
+		SignInURL: s.url("/signin", nil),
+	}
+
+	err := s.send(ctx, to, "Your email address was changed", "email-changed", data)
+	if err != nil {
+		return errors.Wrap(err, "email changed")
+	}
+	return nil
+}
+
+func (s *Service) DataExportReady(ctx context.Context, to, token string, expiresAt time.Time) error {
+	data := struct {
+		DownloadURL string
+		ExpiresAt   string
+	}{
+		DownloadURL: s.url("/users/me/export/download", url.Values{"token": {token}}),
+		ExpiresAt:   expiresAt.UTC().Format("2006-01-02 15:04 MST"),
+	}
+
+	err := s.send(ctx, to, "Your data export is ready", "data-export-ready", data)
+	if err != nil {
+		return errors.Wrap(err, "data export ready")
+	}
+	return nil
+}
+
+func (s *Service) send(ctx context.Context, to, subject, name string, data any) error {
+	text, html, err := s.Templates.render(name, data)
+	if err != nil {
+		return errors.Wrap(err, "send email", "to", to)
+	}
+
+	err = s.Mailer.Send(ctx, Message{
+		From:      s.From,
+		To:        to,
+		Subject:   subject,
+		Plaintext: text,
+		HTML:      html,
+	})
+	if err != nil {
+		return errors.Wrap(err, "send email", "to", to)
+	}
+	return nil
+}
+
+func (s *Service) url(path string, query url.Values) string {
+	link := strings.TrimSuffix(s.BaseURL, "/") + path
+	if len(query) != 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
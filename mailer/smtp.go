@@ -0,0 +1,110 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const smtpsPort = "465"
+
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	body, err := msg.bytes()
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+
+	client, err := s.dial(ctx)
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && s.Port != smtpsPort {
+		err = client.StartTLS(&tls.Config{ServerName: s.Host})
+		if err != nil {
+			return errors.Wrap(err, "smtp send", "to", msg.To)
+		}
+	}
+
+	if s.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host))
+		if err != nil {
+			return errors.Wrap(err, "smtp send", "to", msg.To)
+		}
+	}
+
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+
+	err = client.Mail(from.Address)
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+	err = client.Rcpt(to.Address)
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+
+	wc, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+	_, err = wc.Write(body)
+	if err != nil {
+		wc.Close()
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+	err = wc.Close()
+	if err != nil {
+		return errors.Wrap(err, "smtp send", "to", msg.To)
+	}
+
+	return client.Quit()
+}
+
+func (s *SMTP) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(s.Host, s.Port)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "smtp dial", "address", address)
+	}
+
+	if s.Port == smtpsPort {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.Host})
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "smtp dial", "address", address)
+		}
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "smtp dial", "address", address)
+	}
+	return client, nil
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/fs"
+	texttemplate "text/template"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+type Templates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// MustParseFS parses the "<name>.html" and "<name>.txt" files under dir. Every
+// email needs both of them.
+func MustParseFS(fsys fs.FS, dir string) *Templates {
+	html, err := htmltemplate.ParseFS(fsys, dir+"/*.html")
+	if err != nil {
+		panic(err)
+	}
+	text, err := texttemplate.ParseFS(fsys, dir+"/*.txt")
+	if err != nil {
+		panic(err)
+	}
+	return &Templates{
+		html: html,
+		text: text,
+	}
+}
+
+func (t *Templates) render(name string, data any) (string, string, error) {
+	var text bytes.Buffer
+	err := t.text.ExecuteTemplate(&text, name+".txt", data)
+	if err != nil {
+		return "", "", errors.Wrap(err, "render email", "name", name)
+	}
+
+	var html bytes.Buffer
+	err = t.html.ExecuteTemplate(&html, name+".html", data)
+	if err != nil {
+		return "", "", errors.Wrap(err, "render email", "name", name)
+	}
+	return text.String(), html.String(), nil
+}
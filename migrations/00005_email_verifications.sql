@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- Note: the existing accounts are grandfathered, they signed up before the verification.
+UPDATE users
+SET email_verified_at = NOW();
+
+CREATE TABLE email_verifications (
+  id SERIAL PRIMARY KEY,
+  user_id INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_verifications;
+
+ALTER TABLE users
+  DROP COLUMN email_verified_at;
+-- +goose StatementEnd
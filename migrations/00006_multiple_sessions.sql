@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+  DROP CONSTRAINT sessions_user_id_key,
+  ALTER COLUMN user_id SET NOT NULL,
+  ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+  ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_user_id_idx;
+
+DELETE FROM sessions older
+  USING sessions newer
+  WHERE older.user_id = newer.user_id AND older.id < newer.id;
+
+ALTER TABLE sessions
+  DROP COLUMN ip_address,
+  DROP COLUMN user_agent,
+  DROP COLUMN last_seen_at,
+  DROP COLUMN created_at,
+  ALTER COLUMN user_id DROP NOT NULL,
+  ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+  ADD COLUMN expires_at TIMESTAMPTZ NOT NULL DEFAULT NOW() + INTERVAL '1 day',
+  ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE sessions
+  ALTER COLUMN expires_at DROP DEFAULT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions
+  DROP COLUMN remember,
+  DROP COLUMN expires_at;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN totp_secret TEXT,
+  ADD COLUMN totp_enabled_at TIMESTAMPTZ,
+  ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ,
+  UNIQUE (user_id, code_hash)
+);
+
+CREATE TABLE two_factor_challenges (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  remember BOOLEAN NOT NULL DEFAULT FALSE,
+  attempts INT NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE two_factor_challenges;
+
+DROP TABLE recovery_codes;
+
+ALTER TABLE users
+  DROP COLUMN totp_last_step,
+  DROP COLUMN totp_enabled_at,
+  DROP COLUMN totp_secret;
+-- +goose StatementEnd
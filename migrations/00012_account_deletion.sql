@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE galleries
+  DROP CONSTRAINT galleries_user_id_fkey,
+  ADD CONSTRAINT galleries_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP CONSTRAINT galleries_user_id_fkey,
+  ADD CONSTRAINT galleries_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id);
+
+ALTER TABLE users
+  DROP COLUMN deleted_at;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE data_exports (
+  id SERIAL PRIMARY KEY,
+  user_id INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+  status TEXT NOT NULL,
+  token_hash TEXT UNIQUE,
+  expires_at TIMESTAMPTZ,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE data_exports;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+  ADD COLUMN impersonator_id INT REFERENCES users (id) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions
+  DROP COLUMN impersonator_id;
+-- +goose StatementEnd
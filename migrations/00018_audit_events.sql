@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  actor_id INT REFERENCES users (id) ON DELETE SET NULL,
+  action TEXT NOT NULL,
+  target_id INT REFERENCES users (id) ON DELETE SET NULL,
+  ip_address TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  details JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_id_idx ON audit_events (actor_id, created_at);
+CREATE INDEX audit_events_target_id_idx ON audit_events (target_id, created_at);
+CREATE INDEX audit_events_action_idx ON audit_events (action, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE audit_events;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE invitations (
+  id SERIAL PRIMARY KEY,
+  created_by INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  code_hash TEXT UNIQUE NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_by INT REFERENCES users (id) ON DELETE SET NULL,
+  used_at TIMESTAMPTZ
+);
+
+CREATE INDEX invitations_created_by_idx ON invitations (created_by);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE invitations;
+-- +goose StatementEnd
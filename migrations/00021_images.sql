@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE images (
+  id SERIAL PRIMARY KEY,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  filename TEXT NOT NULL,
+  storage_key TEXT UNIQUE NOT NULL,
+  size BIGINT NOT NULL,
+  content_type TEXT NOT NULL,
+  width INT NOT NULL,
+  height INT NOT NULL,
+  checksum TEXT NOT NULL,
+  uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (gallery_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE images;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN storage_used BIGINT NOT NULL DEFAULT 0;
+
+UPDATE users
+SET storage_used = (
+  SELECT COALESCE(SUM(images.size), 0)
+  FROM images
+    JOIN galleries ON galleries.id = images.gallery_id
+  WHERE galleries.user_id = users.id
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+  DROP COLUMN storage_used;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+  ADD COLUMN exif JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE galleries
+  ADD COLUMN strip_metadata BOOLEAN NOT NULL DEFAULT TRUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN strip_metadata;
+
+ALTER TABLE images
+  DROP COLUMN exif;
+-- +goose StatementEnd
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	ScopeUserRead       = "user:read"
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+
+	MaxAccessTokenLifetime = 365 * 24 * time.Hour
+)
+
+// Scopes lists every scope, which an access token may have.
+var Scopes = []string{ScopeUserRead, ScopeGalleriesRead, ScopeGalleriesWrite}
+
+type AccessToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	Token      string // set only when creating a new access token
+	TokenHash  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+	User       *User // set only when querying by the token
+}
+
+func (a *AccessToken) HasScope(scope string) bool {
+	return slices.Contains(a.Scopes, scope)
+}
+
+// AccessTokenService manages the personal access tokens, which let the
+// scripts of the users call the app without a session.
+type AccessTokenService struct {
+	DB            *sql.DB
+	BytesPerToken int
+}
+
+func (a *AccessTokenService) Create(ctx context.Context, userID int, name string, scopes []string, lifetime time.Duration) (*AccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.Wrap(ErrNameEmpty, "create access token", "user ID", userID)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.Wrap(ErrInvalidScope, "create access token", "user ID", userID)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, errors.Wrap(ErrInvalidScope, "create access token", "user ID", userID, "scope", scope)
+		}
+	}
+	if lifetime <= 0 || lifetime > MaxAccessTokenLifetime {
+		return nil, errors.Wrap(ErrInvalidLifetime, "create access token", "user ID", userID, "lifetime", lifetime)
+	}
+
+	bytesPerToken := max(a.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "create access token", "user ID", userID)
+	}
+	accessToken := AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		Token:     token,
+		TokenHash: a.hash(token),
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	row := a.DB.QueryRowContext(ctx, `
+    INSERT INTO access_tokens (user_id, name, token_hash, scopes, expires_at)
+    VALUES ($1, $2, $3, $4, $5)
+    RETURNING id, created_at;`,
+		accessToken.UserID, accessToken.Name, accessToken.TokenHash, strings.Join(accessToken.Scopes, " "),
+		accessToken.ExpiresAt)
+	err = row.Scan(&accessToken.ID, &accessToken.CreatedAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "create access token", "user ID", userID)
+	}
+	return &accessToken, nil
+}
+
+// User returns the owner of the token and records the use of the token.
+func (a *AccessTokenService) User(ctx context.Context, token, ip string) (*User, *AccessToken, error) {
+	var user User
+	accessToken := AccessToken{
+		TokenHash: a.hash(token),
+	}
+	var scopes string
+	row := a.DB.QueryRowContext(ctx, `
+    SELECT access_tokens.id, access_tokens.name, access_tokens.scopes, access_tokens.created_at,
+      access_tokens.expires_at, access_tokens.last_used_at, access_tokens.last_used_ip,
+      users.id, users.name, users.email, users.email_verified_at, users.totp_enabled_at, users.role
+    FROM access_tokens
+    JOIN users ON users.id = access_tokens.user_id
+    WHERE access_tokens.token_hash = $1 AND users.disabled_at IS NULL AND users.deleted_at IS NULL;`,
+		accessToken.TokenHash)
+	err := row.Scan(&accessToken.ID, &accessToken.Name, &scopes, &accessToken.CreatedAt,
+		&accessToken.ExpiresAt, &accessToken.LastUsedAt, &accessToken.LastUsedIP,
+		&user.ID, &user.Name, &user.Email, &user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, nil, errors.Wrap(err, "access token user")
+	}
+	accessToken.UserID = user.ID
+	accessToken.User = &user
+	accessToken.Scopes = strings.Fields(scopes)
+
+	if time.Now().After(accessToken.ExpiresAt) {
+		return nil, nil, errors.Wrap(ErrTokenExpired, "access token user", "access token ID", accessToken.ID)
+	}
+
+	// Note: the scripts may call many times in a row, so the use is recorded at most once a minute per IP address.
+	if accessToken.LastUsedAt == nil || time.Since(*accessToken.LastUsedAt) > lastSeenResolution || accessToken.LastUsedIP != ip {
+		row = a.DB.QueryRowContext(ctx, `
+      UPDATE access_tokens
+      SET last_used_at = NOW(), last_used_ip = $2
+      WHERE id = $1
+      RETURNING last_used_at;`,
+			accessToken.ID, ip)
+		err = row.Scan(&accessToken.LastUsedAt)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "access token user", "access token ID", accessToken.ID)
+		}
+		accessToken.LastUsedIP = ip
+	}
+
+	return &user, &accessToken, nil
+}
+
+func (a *AccessTokenService) ByUserID(ctx context.Context, userID int) ([]AccessToken, error) {
+	rows, err := a.DB.QueryContext(ctx, `
+    SELECT id, name, scopes, created_at, expires_at, last_used_at, last_used_ip
+    FROM access_tokens
+    WHERE user_id = $1
+    ORDER BY created_at DESC;`,
+		userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "access tokens by user ID", "user ID", userID)
+	}
+	defer rows.Close()
+
+	var accessTokens []AccessToken
+	for rows.Next() {
+		accessToken := AccessToken{
+			UserID: userID,
+		}
+		var scopes string
+		err = rows.Scan(&accessToken.ID, &accessToken.Name, &scopes, &accessToken.CreatedAt, &accessToken.ExpiresAt,
+			&accessToken.LastUsedAt, &accessToken.LastUsedIP)
+		if err != nil {
+			return nil, errors.Wrap(err, "access tokens by user ID", "user ID", userID)
+		}
+		accessToken.Scopes = strings.Fields(scopes)
+		accessTokens = append(accessTokens, accessToken)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "access tokens by user ID", "user ID", userID)
+	}
+	return accessTokens, nil
+}
+
+func (a *AccessTokenService) Delete(ctx context.Context, userID, id int) error {
+	result, err := a.DB.ExecContext(ctx, `
+    DELETE FROM access_tokens
+    WHERE id = $1 AND user_id = $2;`,
+		id, userID)
+	if err != nil {
+		return errors.Wrap(err, "delete access token", "user ID", userID, "ID", id)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "delete access token", "user ID", userID, "ID", id)
+	}
+	if affected == 0 {
+		return errors.Wrap(ErrNotFound, "delete access token", "user ID", userID, "ID", id)
+	}
+	return nil
+}
+
+func (a *AccessTokenService) DeleteExpired(ctx context.Context) error {
+	_, err := a.DB.ExecContext(ctx, `
+    DELETE FROM access_tokens
+    WHERE expires_at < NOW();`)
+	if err != nil {
+		return errors.Wrap(err, "delete expired access tokens")
+	}
+	return nil
+}
+
+func (a *AccessTokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	DefaultDeletionGracePeriod = 30 * 24 * time.Hour
+)
+
+// AccountDeletionService deletes accounts in two steps: the deletion request
+// signs the user out everywhere and hides the galleries, then the account and
+// all of its data is purged after the grace period. Signing in during the
+// grace period restores the account.
+type AccountDeletionService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	GracePeriod    time.Duration
+}
+
+func (a *AccountDeletionService) Request(ctx context.Context, userID int) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "request account deletion", "user ID", userID)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+    UPDATE users
+    SET deleted_at = NOW()
+    WHERE id = $1 AND deleted_at IS NULL;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "request account deletion", "user ID", userID)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "request account deletion", "user ID", userID)
+	}
+	if n == 0 {
+		return errors.Wrap(ErrNotFound, "request account deletion", "user ID", userID)
+	}
+
+	for _, table := range []string{"sessions", "password_resets", "email_verifications", "email_changes", "two_factor_challenges", "access_tokens"} {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1;`, userID)
+		if err != nil {
+			return errors.Wrap(err, "request account deletion", "user ID", userID, "table", table)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "request account deletion", "user ID", userID)
+	}
+	return nil
+}
+
+// Restore cancels the deletion of the account. It returns ErrNotFound if the
+// grace period is over.
+func (a *AccountDeletionService) Restore(ctx context.Context, userID int) error {
+	result, err := a.DB.ExecContext(ctx, `
+    UPDATE users
+    SET deleted_at = NULL
+    WHERE id = $1 AND deleted_at > $2;`,
+		userID, time.Now().Add(-a.gracePeriod()))
+	if err != nil {
+		return errors.Wrap(err, "restore account", "user ID", userID)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "restore account", "user ID", userID)
+	}
+	if n == 0 {
+		return errors.Wrap(ErrNotFound, "restore account", "user ID", userID)
+	}
+	return nil
+}
+
+// PurgeAt tells when the account deleted at the given time is purged.
+func (a *AccountDeletionService) PurgeAt(deletedAt time.Time) time.Time {
+	return deletedAt.Add(a.gracePeriod())
+}
+
+// Purge deletes the accounts whose grace period is over. The galleries are
+// deleted one by one, so their image directories are removed as well, and the
+// rest of the data is removed by the cascading foreign keys.
+func (a *AccountDeletionService) Purge(ctx context.Context) error {
+	rows, err := a.DB.QueryContext(ctx, `
+    SELECT id
+    FROM users
+    WHERE deleted_at <= $1;`,
+		time.Now().Add(-a.gracePeriod()))
+	if err != nil {
+		return errors.Wrap(err, "purge accounts")
+	}
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		err = rows.Scan(&userID)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "purge accounts")
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return errors.Wrap(rows.Err(), "purge accounts")
+	}
+
+	for _, userID := range userIDs {
+		err = a.purge(ctx, userID)
+		if err != nil {
+			// Note: the other accounts are still purged, this one is retried next time.
+			log.Printf("ERROR: purge accounts: %v\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (a *AccountDeletionService) purge(ctx context.Context, userID int) error {
+	galleries, err := a.GalleryService.ByUserID(ctx, userID)
+	if err != nil {
+		return errors.Wrap(err, "purge account", "user ID", userID)
+	}
+
+	for _, gallery := range galleries {
+		err = a.GalleryService.Delete(ctx, gallery.ID)
+		if err != nil {
+			return errors.Wrap(err, "purge account", "user ID", userID)
+		}
+	}
+
+	_, err = a.DB.ExecContext(ctx, `
+    DELETE FROM users
+    WHERE id = $1 AND deleted_at IS NOT NULL;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "purge account", "user ID", userID)
+	}
+	return nil
+}
+
+func (a *AccountDeletionService) gracePeriod() time.Duration {
+	if a.GracePeriod == 0 {
+		return DefaultDeletionGracePeriod
+	}
+	return a.GracePeriod
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	AuditSignUp                 = "user.signup"
+	AuditSignIn                 = "signin.success"
+	AuditSignInFailed           = "signin.failure"
+	AuditSignOut                = "signout"
+	AuditPasswordResetRequested = "password.reset_requested"
+	AuditPasswordReset          = "password.reset"
+	AuditPasswordChanged        = "password.changed"
+	AuditEmailChanged           = "email.changed"
+	AuditSessionDeleted         = "session.deleted"
+	AuditOtherSessionsDeleted   = "session.others_deleted"
+	AuditAllSessionsDeleted     = "session.all_deleted"
+	AuditTwoFactorEnabled       = "2fa.enabled"
+	AuditTwoFactorDisabled      = "2fa.disabled"
+	AuditIdentityLinked         = "identity.linked"
+	AuditIdentityUnlinked       = "identity.unlinked"
+	AuditAccessTokenCreated     = "access_token.created"
+	AuditAccessTokenRevoked     = "access_token.revoked"
+	AuditAccountDeletionRequest = "account.deletion_requested"
+	AuditUserDisabled           = "user.disabled"
+	AuditUserEnabled            = "user.enabled"
+	AuditGalleryDeleted         = "gallery.deleted"
+	AuditImageDeleted           = "image.deleted"
+	AuditImpersonationStart     = "impersonation.start"
+	AuditImpersonationStop      = "impersonation.stop"
+
+	auditEventsPerPage = 50
+)
+
+// AuditActions lists every action, e.g. for filtering.
+var AuditActions = []string{
+	AuditSignUp, AuditSignIn, AuditSignInFailed, AuditSignOut,
+	AuditPasswordResetRequested, AuditPasswordReset, AuditPasswordChanged, AuditEmailChanged,
+	AuditSessionDeleted, AuditOtherSessionsDeleted, AuditAllSessionsDeleted,
+	AuditTwoFactorEnabled, AuditTwoFactorDisabled, AuditIdentityLinked, AuditIdentityUnlinked,
+	AuditAccessTokenCreated, AuditAccessTokenRevoked,
+	AuditAccountDeletionRequest, AuditUserDisabled, AuditUserEnabled,
+	AuditGalleryDeleted, AuditImageDeleted, AuditImpersonationStart, AuditImpersonationStop,
+}
+
+type AuditEvent struct {
+	ID        int64
+	ActorID   *int
+	Action    string
+	TargetID  *int
+	IPAddress string
+	UserAgent string
+	Details   map[string]any
+	CreatedAt time.Time
+
+	ActorEmail string
+	// TargetEmail is set when querying. When recording, it looks up the target
+	// if only the email is known, e.g. at a failed sign in.
+	TargetEmail string
+}
+
+// AuditFilter narrows the events. The zero fields do not filter.
+type AuditFilter struct {
+	Action string
+	// UserID matches both the actor and the target.
+	UserID int
+	// UserEmail matches both the actor and the target.
+	UserEmail string
+	Since     time.Time
+	Until     time.Time
+}
+
+// AuditService records the security relevant events. The events are kept even
+// if the users are deleted, only their IDs are cleared.
+type AuditService struct {
+	DB *sql.DB
+}
+
+func (a *AuditService) Record(ctx context.Context, event AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return errors.Wrap(err, "record audit event", "action", event.Action)
+	}
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	_, err = a.DB.ExecContext(ctx, `
+    INSERT INTO audit_events (actor_id, action, target_id, ip_address, user_agent, details)
+    VALUES ($1, $2, COALESCE($3, (SELECT id FROM users WHERE email = $7)), $4, $5, $6);`,
+		event.ActorID, event.Action, event.TargetID, event.IPAddress, event.UserAgent, details,
+		strings.ToLower(event.TargetEmail))
+	if err != nil {
+		return errors.Wrap(err, "record audit event", "action", event.Action)
+	}
+	return nil
+}
+
+// Search returns the events matching the filter, the newest first.
+func (a *AuditService) Search(ctx context.Context, filter AuditFilter, page int) ([]AuditEvent, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Action != "" {
+		where("audit_events.action = $%d", filter.Action)
+	}
+	if filter.UserID != 0 {
+		where("(audit_events.actor_id = $%[1]d OR audit_events.target_id = $%[1]d)", filter.UserID)
+	}
+	if filter.UserEmail != "" {
+		where("(actors.email = $%[1]d OR targets.email = $%[1]d)", strings.ToLower(filter.UserEmail))
+	}
+	if !filter.Since.IsZero() {
+		where("audit_events.created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("audit_events.created_at < $%d", filter.Until)
+	}
+	query := `
+    SELECT audit_events.id, audit_events.actor_id, audit_events.action, audit_events.target_id,
+      audit_events.ip_address, audit_events.user_agent, audit_events.details, audit_events.created_at,
+      COALESCE(actors.email, ''), COALESCE(targets.email, '')
+    FROM audit_events
+    LEFT JOIN users AS actors ON actors.id = audit_events.actor_id
+    LEFT JOIN users AS targets ON targets.id = audit_events.target_id`
+	if len(conditions) > 0 {
+		query += "\n    WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, auditEventsPerPage, max(page, 0)*auditEventsPerPage)
+	query += fmt.Sprintf("\n    ORDER BY audit_events.id DESC\n    LIMIT $%d OFFSET $%d;", len(args)-1, len(args))
+
+	rows, err := a.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "search audit events")
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0, auditEventsPerPage)
+	for rows.Next() {
+		var event AuditEvent
+		var details []byte
+		err = rows.Scan(&event.ID, &event.ActorID, &event.Action, &event.TargetID, &event.IPAddress, &event.UserAgent,
+			&details, &event.CreatedAt, &event.ActorEmail, &event.TargetEmail)
+		if err != nil {
+			return nil, errors.Wrap(err, "search audit events")
+		}
+		err = json.Unmarshal(details, &event.Details)
+		if err != nil {
+			return nil, errors.Wrap(err, "search audit events", "ID", event.ID)
+		}
+		events = append(events, event)
+	}
+	if rows.Err() != nil {
+		return nil, errors.Wrap(rows.Err(), "search audit events")
+	}
+	return events, nil
+}
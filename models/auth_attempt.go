@@ -0,0 +1,166 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	AttemptSignIn         = "signin"
+	AttemptForgotPassword = "forgot-password"
+	AttemptSignInLink     = "signin-link"
+
+	DefaultMaxFailures      = 5
+	DefaultMaxFailuresPerIP = 20
+	DefaultLockout          = 1 * time.Minute
+	DefaultMaxLockout       = 1 * time.Hour
+	DefaultAttemptWindow    = 15 * time.Minute
+)
+
+// AttemptService counts the failed attempts of an action per IP address and
+// per account. After too many failures the key is locked, and the lockout
+// doubles with every further failure.
+type AttemptService struct {
+	DB *sql.DB
+
+	MaxFailures      int
+	MaxFailuresPerIP int
+	Lockout          time.Duration
+	MaxLockout       time.Duration
+	Window           time.Duration
+}
+
+type attemptKey struct {
+	key         string
+	maxFailures int
+}
+
+// Check returns ErrTooManyAttempts if either the IP address or the account
+// is locked. The account can be empty if it is not known yet.
+func (a *AttemptService) Check(ctx context.Context, action, ip, account string) error {
+	for _, key := range a.keys(action, ip, account) {
+		var lockedUntil sql.NullTime
+		row := a.DB.QueryRowContext(ctx, `
+      SELECT locked_until
+      FROM auth_attempts
+      WHERE key = $1;`,
+			key.key)
+		err := row.Scan(&lockedUntil)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return errors.Wrap(err, "check attempts", "key", key.key)
+		}
+
+		if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+			return errors.Wrap(ErrTooManyAttempts, "check attempts", "key", key.key, "locked until", lockedUntil.Time)
+		}
+	}
+	return nil
+}
+
+func (a *AttemptService) Fail(ctx context.Context, action, ip, account string) error {
+	now := time.Now()
+	for _, key := range a.keys(action, ip, account) {
+		var failures int
+		row := a.DB.QueryRowContext(ctx, `
+      INSERT INTO auth_attempts (key, failures, updated_at)
+      VALUES ($1, 1, $2) ON CONFLICT (key)
+      DO UPDATE SET
+        failures = CASE WHEN auth_attempts.updated_at < $3 THEN 1 ELSE auth_attempts.failures + 1 END,
+        updated_at = $2
+      RETURNING failures;`,
+			key.key, now, now.Add(-a.window()))
+		err := row.Scan(&failures)
+		if err != nil {
+			return errors.Wrap(err, "fail attempt", "key", key.key)
+		}
+
+		if failures < key.maxFailures {
+			continue
+		}
+
+		_, err = a.DB.ExecContext(ctx, `
+      UPDATE auth_attempts
+      SET locked_until = $2
+      WHERE key = $1;`,
+			key.key, now.Add(a.lockout(failures-key.maxFailures)))
+		if err != nil {
+			return errors.Wrap(err, "fail attempt", "key", key.key)
+		}
+	}
+	return nil
+}
+
+// Reset forgets the failures of the account. The failures of the IP address
+// are kept, otherwise one known account would be enough to reset them.
+func (a *AttemptService) Reset(ctx context.Context, action, account string) error {
+	if account == "" {
+		return nil
+	}
+
+	key := a.accountKey(action, account)
+	_, err := a.DB.ExecContext(ctx, `
+    DELETE FROM auth_attempts
+    WHERE key = $1;`,
+		key)
+	if err != nil {
+		return errors.Wrap(err, "reset attempts", "key", key)
+	}
+	return nil
+}
+
+func (a *AttemptService) DeleteStale(ctx context.Context) error {
+	now := time.Now()
+	_, err := a.DB.ExecContext(ctx, `
+    DELETE FROM auth_attempts
+    WHERE updated_at < $1 AND (locked_until IS NULL OR locked_until < $2);`,
+		now.Add(-a.window()), now)
+	if err != nil {
+		return errors.Wrap(err, "delete stale attempts")
+	}
+	return nil
+}
+
+func (a *AttemptService) keys(action, ip, account string) []attemptKey {
+	keys := []attemptKey{
+		{
+			key:         action + ":ip:" + ip,
+			maxFailures: cmp.Or(a.MaxFailuresPerIP, DefaultMaxFailuresPerIP),
+		},
+	}
+	if account != "" {
+		keys = append(keys, attemptKey{
+			key:         a.accountKey(action, account),
+			maxFailures: cmp.Or(a.MaxFailures, DefaultMaxFailures),
+		})
+	}
+	return keys
+}
+
+func (a *AttemptService) accountKey(action, account string) string {
+	return action + ":account:" + strings.ToLower(account)
+}
+
+func (a *AttemptService) lockout(exceeded int) time.Duration {
+	lockout := cmp.Or(a.Lockout, DefaultLockout)
+	maxLockout := cmp.Or(a.MaxLockout, DefaultMaxLockout)
+
+	for range exceeded {
+		lockout *= 2
+		if lockout >= maxLockout {
+			return maxLockout
+		}
+	}
+	return min(lockout, maxLockout)
+}
+
+func (a *AttemptService) window() time.Duration {
+	return cmp.Or(a.Window, DefaultAttemptWindow)
+}
@@ -0,0 +1,407 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	DefaultExportDuration = 48 * time.Hour
+	DefaultExportDir      = "/exports"
+
+	ExportPending  = "pending"
+	ExportBuilding = "building"
+	ExportReady    = "ready"
+	ExportFailed   = "failed"
+
+	// exportStaleAfter is the time after a building export is considered
+	// abandoned, e.g. because the app was restarted meanwhile.
+	exportStaleAfter = time.Hour
+)
+
+type DataExport struct {
+	ID        int
+	UserID    int
+	Status    string
+	Token     string // set only when the export gets ready
+	TokenHash string
+	ExpiresAt *time.Time
+	UpdatedAt time.Time
+	Path      string
+}
+
+// DataExportService builds ZIP archives of the personal data of the users in
+// the background. The archive contains the user record and the galleries as
+// JSON, and the image files of the galleries.
+type DataExportService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	BytesPerToken  int
+	Duration       time.Duration
+
+	Dir string
+}
+
+// ExportNotifier is called when the export is ready to download with the
+// token, which is needed for the download.
+type ExportNotifier func(ctx context.Context, email, token string, expiresAt time.Time) error
+
+// Request queues a new export of the user. If an export is being built
+// already, that one is returned.
+func (d *DataExportService) Request(ctx context.Context, userID int) (*DataExport, error) {
+	export := DataExport{
+		UserID: userID,
+	}
+	row := d.DB.QueryRowContext(ctx, `
+    INSERT INTO data_exports (user_id, status)
+    VALUES ($1, $2) ON CONFLICT (user_id)
+    DO UPDATE SET status = $2, token_hash = NULL, expires_at = NULL, updated_at = NOW()
+    WHERE data_exports.status NOT IN ($2, $3) OR data_exports.updated_at < $4
+    RETURNING id, status, updated_at;`,
+		userID, ExportPending, ExportBuilding, time.Now().Add(-exportStaleAfter))
+	err := row.Scan(&export.ID, &export.Status, &export.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return d.ByUserID(ctx, userID)
+		}
+		return nil, errors.Wrap(err, "request data export", "user ID", userID)
+	}
+	export.Path = d.path(userID)
+
+	return &export, nil
+}
+
+func (d *DataExportService) ByUserID(ctx context.Context, userID int) (*DataExport, error) {
+	export := DataExport{
+		UserID: userID,
+		Path:   d.path(userID),
+	}
+	row := d.DB.QueryRowContext(ctx, `
+    SELECT id, status, expires_at, updated_at
+    FROM data_exports
+    WHERE user_id = $1;`,
+		userID)
+	err := row.Scan(&export.ID, &export.Status, &export.ExpiresAt, &export.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "data export by user ID", "user ID", userID)
+	}
+	return &export, nil
+}
+
+// Download returns the ready export of the user, which belongs to the token.
+func (d *DataExportService) Download(ctx context.Context, userID int, token string) (*DataExport, error) {
+	export := DataExport{
+		UserID:    userID,
+		Status:    ExportReady,
+		TokenHash: d.hash(token),
+		Path:      d.path(userID),
+	}
+	row := d.DB.QueryRowContext(ctx, `
+    SELECT id, expires_at, updated_at
+    FROM data_exports
+    WHERE user_id = $1 AND status = $2 AND token_hash = $3;`,
+		export.UserID, export.Status, export.TokenHash)
+	err := row.Scan(&export.ID, &export.ExpiresAt, &export.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "download data export", "user ID", userID)
+	}
+
+	if export.ExpiresAt == nil || time.Now().After(*export.ExpiresAt) {
+		return nil, errors.Wrap(ErrTokenExpired, "download data export", "user ID", userID)
+	}
+	return &export, nil
+}
+
+// BuildPending builds the queued exports one by one and notifies the users
+// about the ready ones.
+func (d *DataExportService) BuildPending(ctx context.Context, notify ExportNotifier) error {
+	for {
+		export, err := d.claim(ctx)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return errors.Wrap(err, "build pending data exports")
+		}
+
+		err = d.build(ctx, export, notify)
+		if err != nil {
+			// Note: the other exports are still built, this one can be requested again.
+			log.Printf("ERROR: build pending data exports: %v\n", err.Error())
+
+			_, err = d.DB.ExecContext(ctx, `
+        UPDATE data_exports
+        SET status = $2, updated_at = NOW()
+        WHERE id = $1;`,
+				export.ID, ExportFailed)
+			if err != nil {
+				return errors.Wrap(err, "build pending data exports")
+			}
+		}
+	}
+}
+
+// DeleteExpired deletes the exports, whose download link is expired, with
+// their archives.
+func (d *DataExportService) DeleteExpired(ctx context.Context) error {
+	rows, err := d.DB.QueryContext(ctx, `
+    DELETE FROM data_exports
+    WHERE expires_at < NOW()
+    RETURNING user_id;`)
+	if err != nil {
+		return errors.Wrap(err, "delete expired data exports")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		err = rows.Scan(&userID)
+		if err != nil {
+			return errors.Wrap(err, "delete expired data exports")
+		}
+
+		err = os.Remove(d.path(userID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrap(err, "delete expired data exports", "user ID", userID)
+		}
+	}
+	if rows.Err() != nil {
+		return errors.Wrap(rows.Err(), "delete expired data exports")
+	}
+	return nil
+}
+
+// claim marks the oldest pending export as building, so another instance of
+// the app does not build it as well.
+func (d *DataExportService) claim(ctx context.Context) (*DataExport, error) {
+	var export DataExport
+	row := d.DB.QueryRowContext(ctx, `
+    UPDATE data_exports
+    SET status = $2, updated_at = NOW()
+    WHERE id = (
+      SELECT id
+      FROM data_exports
+      WHERE status = $1
+      ORDER BY updated_at
+      LIMIT 1
+      FOR UPDATE SKIP LOCKED)
+    RETURNING id, user_id, status, updated_at;`,
+		ExportPending, ExportBuilding)
+	err := row.Scan(&export.ID, &export.UserID, &export.Status, &export.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "claim data export")
+	}
+	export.Path = d.path(export.UserID)
+
+	return &export, nil
+}
+
+func (d *DataExportService) build(ctx context.Context, export *DataExport, notify ExportNotifier) error {
+	user := User{
+		ID: export.UserID,
+	}
+	row := d.DB.QueryRowContext(ctx, `
+    SELECT name, email, email_verified_at, totp_enabled_at
+    FROM users
+    WHERE id = $1;`,
+		user.ID)
+	err := row.Scan(&user.Name, &user.Email, &user.EmailVerifiedAt, &user.TOTPEnabledAt)
+	if err != nil {
+		return errors.Wrap(err, "build data export", "user ID", user.ID)
+	}
+
+	err = d.writeArchive(ctx, export.Path, &user)
+	if err != nil {
+		return errors.Wrap(err, "build data export", "user ID", user.ID)
+	}
+
+	bytesPerToken := max(d.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return errors.Wrap(err, "build data export", "user ID", user.ID)
+	}
+
+	duration := d.Duration
+	if duration == 0 {
+		duration = DefaultExportDuration
+	}
+	expiresAt := time.Now().Add(duration)
+	export.Status = ExportReady
+	export.Token = token
+	export.TokenHash = d.hash(token)
+	export.ExpiresAt = &expiresAt
+
+	_, err = d.DB.ExecContext(ctx, `
+    UPDATE data_exports
+    SET status = $2, token_hash = $3, expires_at = $4, updated_at = NOW()
+    WHERE id = $1;`,
+		export.ID, export.Status, export.TokenHash, export.ExpiresAt)
+	if err != nil {
+		return errors.Wrap(err, "build data export", "user ID", user.ID)
+	}
+
+	err = notify(ctx, user.Email, export.Token, expiresAt)
+	if err != nil {
+		return errors.Wrap(err, "build data export", "user ID", user.ID)
+	}
+	return nil
+}
+
+type exportedUser struct {
+	ID               int        `json:"id"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+}
+
+type exportedGallery struct {
+	ID     int      `json:"id"`
+	Title  string   `json:"title"`
+	Images []string `json:"images"`
+}
+
+type exportedData struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	User       exportedUser      `json:"user"`
+	Galleries  []exportedGallery `json:"galleries"`
+}
+
+// writeArchive writes the archive into a temporary file first, so a half
+// written archive is never downloaded.
+func (d *DataExportService) writeArchive(ctx context.Context, path string, user *User) error {
+	galleries, err := d.GalleryService.ByUserID(ctx, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+
+	data := exportedData{
+		ExportedAt: time.Now().UTC(),
+		User: exportedUser{
+			ID:               user.ID,
+			Name:             user.Name,
+			Email:            user.Email,
+			EmailVerifiedAt:  user.EmailVerifiedAt,
+			TwoFactorEnabled: user.TwoFactorEnabled(),
+		},
+		Galleries: make([]exportedGallery, 0, len(galleries)),
+	}
+	for _, gallery := range galleries {
+		images, err := d.GalleryService.Images(ctx, gallery.ID)
+		if err != nil {
+			return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+		}
+
+		exported := exportedGallery{
+			ID:     gallery.ID,
+			Title:  gallery.Title,
+			Images: make([]string, 0, len(images)),
+		}
+		for _, image := range images {
+			name := fmt.Sprintf("galleries/%d/%s", gallery.ID, image.Filename)
+			r, _, err := d.GalleryService.openOriginal(ctx, &image)
+			if err != nil {
+				return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+			}
+			err = addFile(archive, name, r)
+			r.Close()
+			if err != nil {
+				return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+			}
+			exported.Images = append(exported.Images, name)
+		}
+		data.Galleries = append(data.Galleries, exported)
+	}
+
+	w, err := archive.Create("data.json")
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(data)
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "write data export archive", "user ID", user.ID)
+	}
+	return nil
+}
+
+func addFile(archive *zip.Writer, name string, src io.Reader) error {
+	// Note: the images are compressed already, so they are only stored.
+	dst, err := archive.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return errors.Wrap(err, "add file to archive", "name", name)
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return errors.Wrap(err, "add file to archive", "name", name)
+	}
+	return nil
+}
+
+func (d *DataExportService) path(userID int) string {
+	dir := d.Dir
+	if dir == "" {
+		dir = DefaultExportDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("user-%d.zip", userID))
+}
+
+func (d *DataExportService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
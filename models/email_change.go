@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+type EmailChange struct {
+	ID        int
+	UserID    int
+	NewEmail  string
+	OldEmail  string // set only when consuming the email change
+	Token     string // set only when creating a new email change
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailChangeService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+// Create stores a pending email change of the user. The email is changed
+// only when the token sent to the new address is consumed.
+func (e *EmailChangeService) Create(ctx context.Context, userID int, newEmail string) (*EmailChange, error) {
+	newEmail = strings.ToLower(strings.TrimSpace(newEmail))
+	err := checkEmail(newEmail)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change create", "user ID", userID)
+	}
+
+	var taken bool
+	row := e.DB.QueryRowContext(ctx, `
+    SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`,
+		newEmail)
+	err = row.Scan(&taken)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change create", "user ID", userID)
+	}
+	if taken {
+		return nil, errors.Wrap(ErrEmailTaken, "email change create", "user ID", userID)
+	}
+
+	bytesPerToken := max(e.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change create", "user ID", userID)
+	}
+
+	duration := e.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: e.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = e.DB.QueryRowContext(ctx, `
+    INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+    VALUES ($1, $2, $3, $4) ON CONFLICT (user_id)
+    DO UPDATE SET new_email = $2, token_hash = $3, expires_at = $4
+    RETURNING id;`,
+		change.UserID, change.NewEmail, change.TokenHash, change.ExpiresAt)
+	err = row.Scan(&change.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change create", "user ID", userID)
+	}
+
+	return &change, nil
+}
+
+// Pending returns the new email address waiting for confirmation.
+func (e *EmailChangeService) Pending(ctx context.Context, userID int) (string, error) {
+	var newEmail string
+	row := e.DB.QueryRowContext(ctx, `
+    SELECT new_email
+    FROM email_changes
+    WHERE user_id = $1 AND expires_at > NOW();`,
+		userID)
+	err := row.Scan(&newEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return "", errors.Wrap(err, "email change pending", "user ID", userID)
+	}
+	return newEmail, nil
+}
+
+func (e *EmailChangeService) Cancel(ctx context.Context, userID int) error {
+	_, err := e.DB.ExecContext(ctx, `
+    DELETE FROM email_changes
+    WHERE user_id = $1;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "email change cancel", "user ID", userID)
+	}
+	return nil
+}
+
+// Consume changes the email of the user. The new address counts as verified,
+// because the token was sent to it.
+func (e *EmailChangeService) Consume(ctx context.Context, token string) (*EmailChange, error) {
+	tokenHash := e.hash(token)
+
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change consume")
+	}
+	defer tx.Rollback()
+
+	var change EmailChange
+	row := tx.QueryRowContext(ctx, `
+    DELETE FROM email_changes
+    WHERE token_hash = $1
+    RETURNING id, user_id, new_email, expires_at;`,
+		tokenHash)
+	err = row.Scan(&change.ID, &change.UserID, &change.NewEmail, &change.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "email change consume")
+	}
+
+	if time.Now().After(change.ExpiresAt) {
+		return nil, errors.Wrap(ErrTokenExpired, "email change consume", "user ID", change.UserID)
+	}
+
+	row = tx.QueryRowContext(ctx, `
+    SELECT email
+    FROM users
+    WHERE id = $1
+    FOR UPDATE;`,
+		change.UserID)
+	err = row.Scan(&change.OldEmail)
+	if err != nil {
+		return nil, errors.Wrap(err, "email change consume", "user ID", change.UserID)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE users
+    SET email = $2, email_verified_at = NOW()
+    WHERE id = $1;`,
+		change.UserID, change.NewEmail)
+	if err != nil {
+		// Note: the address could be taken since the change was requested.
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			err = ErrEmailTaken
+		}
+		return nil, errors.Wrap(err, "email change consume", "user ID", change.UserID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "email change consume", "user ID", change.UserID)
+	}
+	return &change, nil
+}
+
+func (e *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
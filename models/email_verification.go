@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+)
+
+type EmailVerification struct {
+	ID        int
+	UserID    int
+	Token     string // set only when creating a new verification
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (e *EmailVerificationService) Create(ctx context.Context, userID int) (*EmailVerification, error) {
+	bytesPerToken := max(e.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "email verification create", "user ID", userID)
+	}
+
+	duration := e.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: e.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := e.DB.QueryRowContext(ctx, `
+    INSERT INTO email_verifications (user_id, token_hash, expires_at)
+    VALUES ($1, $2, $3) ON CONFLICT (user_id)
+    DO UPDATE SET token_hash = $2, expires_at = $3
+    RETURNING id;`,
+		verification.UserID, verification.TokenHash, verification.ExpiresAt)
+	err = row.Scan(&verification.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "email verification create", "user ID", userID)
+	}
+
+	return &verification, nil
+}
+
+func (e *EmailVerificationService) Consume(ctx context.Context, token string) (*User, error) {
+	tokenHash := e.hash(token)
+
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "email verification consume")
+	}
+	defer tx.Rollback()
+
+	var user User
+	var verification EmailVerification
+	row := tx.QueryRowContext(ctx, `
+    DELETE FROM email_verifications
+    WHERE token_hash = $1
+    RETURNING id, user_id, expires_at;`,
+		tokenHash)
+	err = row.Scan(&verification.ID, &verification.UserID, &verification.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "email verification consume")
+	}
+
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, errors.Wrap(ErrTokenExpired, "email verification consume", "user ID", verification.UserID)
+	}
+
+	row = tx.QueryRowContext(ctx, `
+    UPDATE users
+    SET email_verified_at = COALESCE(email_verified_at, NOW())
+    WHERE id = $1
+    RETURNING id, name, email, email_verified_at;`,
+		verification.UserID)
+	err = row.Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "email verification consume")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "email verification consume")
+	}
+	return &user, nil
+}
+
+func (e *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
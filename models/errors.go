@@ -10,9 +10,36 @@ import (
 )
 
 var (
-	ErrNotFound   = errors.New("no resource is found")
-	ErrEmailTaken = errors.New("email address is already in use")
-	ErrPwMismatch = errors.New("mismatching password")
+	ErrNotFound     = errors.New("no resource is found")
+	ErrEmailTaken   = errors.New("email address is already in use")
+	ErrEmailInvalid = errors.New("invalid email address")
+	ErrPwMismatch   = errors.New("mismatching password")
+	ErrWrongPw      = errors.New("wrong password")
+	ErrNameEmpty    = errors.New("empty name")
+
+	ErrTokenExpired = errors.New("token expired")
+
+	ErrInvalidCode      = errors.New("invalid verification code")
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+	ErrTooManyAttempts = errors.New("too many attempts")
+	ErrAccountDisabled = errors.New("account is disabled")
+
+	ErrIdentityTaken    = errors.New("identity is linked to another user")
+	ErrLastSignInMethod = errors.New("last sign in method of the user")
+
+	ErrInvalidScope    = errors.New("invalid scope")
+	ErrInvalidLifetime = errors.New("invalid lifetime")
+
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrDomainNotAllowed   = errors.New("email domain is not allowed")
+	ErrInvalidInvitation  = errors.New("invalid invitation code")
+	ErrTooManyInvitations = errors.New("too many pending invitations")
+
+	ErrUnknownRendition = errors.New("unknown rendition")
+	ErrFileTooLarge     = errors.New("file too large")
+	ErrGalleryFull      = errors.New("gallery is full")
+	ErrStorageQuota     = errors.New("storage quota exceeded")
 )
 
 type FileError struct {
@@ -23,25 +50,25 @@ func (f FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", f.Issue)
 }
 
-func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
+func checkContentType(r io.ReadSeeker, allowedTypes []string) (string, error) {
 	testBytes := make([]byte, 512)
 	_, err := r.Read(testBytes)
 	if err != nil {
-		return errors.Wrap(err, "checking content type")
+		return "", errors.Wrap(err, "checking content type")
 	}
 
-	_, err = r.Seek(io.SeekStart, 0)
+	_, err = r.Seek(0, io.SeekStart)
 	if err != nil {
-		return errors.Wrap(err, "checking content type")
+		return "", errors.Wrap(err, "checking content type")
 	}
 
 	contentType := http.DetectContentType(testBytes)
 	for _, t := range allowedTypes {
 		if contentType == t {
-			return nil
+			return contentType, nil
 		}
 	}
-	return FileError{
+	return "", FileError{
 		Issue: fmt.Sprintf("invalid content type: %v", contentType),
 	}
 }
@@ -0,0 +1,564 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// EXIF is the metadata of the camera, which is read from the JPEGs at upload.
+// The serial numbers are not kept.
+type EXIF struct {
+	TakenAt *time.Time `json:"taken_at,omitempty"`
+	Make    string     `json:"make,omitempty"`
+	Model   string     `json:"model,omitempty"`
+	Lens    string     `json:"lens,omitempty"`
+	// ExposureTime is in seconds, e.g. "1/125" or "2".
+	ExposureTime string  `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"`
+	// Orientation is the EXIF orientation from 1 to 8, 0 means 1.
+	Orientation int      `json:"orientation,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+}
+
+// Shared is the EXIF without the location.
+func (e EXIF) Shared() EXIF {
+	e.Latitude = nil
+	e.Longitude = nil
+	return e
+}
+
+// Summary is a short line about the shot, e.g. "Canon EOS R5, 1/125 s, f/2.8,
+// ISO 100".
+func (e EXIF) Summary() string {
+	parts := make([]string, 0, 4)
+	if e.Model != "" {
+		camera := e.Model
+		if e.Make != "" && !strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+			camera = e.Make + " " + e.Model
+		}
+		parts = append(parts, camera)
+	}
+	if e.ExposureTime != "" {
+		parts = append(parts, e.ExposureTime+" s")
+	}
+	if e.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", e.FNumber))
+	}
+	if e.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// swapsAxes tells whether the image is turned by 90 degrees to be shown.
+func (e EXIF) swapsAxes() bool {
+	return e.Orientation >= 5 && e.Orientation <= 8
+}
+
+const (
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegSOS  = 0xda
+	jpegAPP1 = 0xe1
+
+	exifHeader         = "Exif\x00\x00"
+	xmpHeader          = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtensionHeader = "http://ns.adobe.com/xmp/extension/\x00"
+	exifDateLayout     = "2006:01:02 15:04:05"
+	maxIFDEntries      = 1000
+)
+
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829a
+	tagFNumber            = 0x829d
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920a
+	tagMakerNote          = 0x927c
+	tagCameraOwnerName    = 0xa430
+	tagBodySerialNumber   = 0xa431
+	tagLensModel          = 0xa434
+	tagLensSerialNumber   = 0xa435
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+)
+
+// privateEXIFTags are blanked in the Exif IFD. The maker notes are there too,
+// because the cameras hide their serial numbers in them.
+var privateEXIFTags = map[uint16]bool{
+	tagMakerNote:        true,
+	tagCameraOwnerName:  true,
+	tagBodySerialNumber: true,
+	tagLensSerialNumber: true,
+}
+
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// readJPEGHeader reads the segments till the start of the scan, which is the
+// last one. The reader is at the image data after it.
+func readJPEGHeader(r *bufio.Reader) ([]jpegSegment, error) {
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "read jpeg header")
+	}
+	if soi[0] != 0xff || soi[1] != jpegSOI {
+		return nil, errors.New("not a jpeg")
+	}
+
+	var segments []jpegSegment
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "read jpeg header")
+		}
+		if b != 0xff {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read jpeg header")
+		}
+		if marker == jpegEOI {
+			return nil, errors.New("jpeg without scan")
+		}
+
+		var length [2]byte
+		_, err = io.ReadFull(r, length[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "read jpeg header")
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return nil, errors.New("invalid jpeg segment length")
+		}
+		data := make([]byte, n-2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "read jpeg header")
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, data: data})
+		if marker == jpegSOS {
+			return segments, nil
+		}
+	}
+}
+
+// parseEXIF reads the EXIF of a JPEG. A broken EXIF gives an empty one, the
+// upload must not fail because of the camera.
+func parseEXIF(r io.Reader) EXIF {
+	segments, err := readJPEGHeader(bufio.NewReader(r))
+	if err != nil {
+		return EXIF{}
+	}
+	for _, segment := range segments {
+		if segment.marker == jpegAPP1 && bytes.HasPrefix(segment.data, []byte(exifHeader)) {
+			t, err := newTIFF(segment.data[len(exifHeader):])
+			if err != nil {
+				return EXIF{}
+			}
+			return t.exif()
+		}
+	}
+	return EXIF{}
+}
+
+// stripEXIF copies the JPEG without the location and the serial numbers. The
+// tags are blanked in place, so the offsets in the EXIF stay valid, and the
+// XMP is dropped, because it can have the location too.
+func stripEXIF(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	segments, err := readJPEGHeader(br)
+	if err != nil {
+		return errors.Wrap(err, "strip exif")
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xff, jpegSOI})
+	for _, segment := range segments {
+		if segment.marker == jpegAPP1 {
+			switch {
+			case bytes.HasPrefix(segment.data, []byte(exifHeader)):
+				t, err := newTIFF(segment.data[len(exifHeader):])
+				if err != nil {
+					// Note: an unreadable EXIF may still have the location.
+					continue
+				}
+				err = t.blankPrivateTags()
+				if err != nil {
+					// Note: the EXIF is dropped, if the location may be left in it.
+					continue
+				}
+			case bytes.HasPrefix(segment.data, []byte(xmpHeader)),
+				bytes.HasPrefix(segment.data, []byte(xmpExtensionHeader)):
+				continue
+			}
+		}
+		bw.Write([]byte{0xff, segment.marker})
+		bw.Write(binary.BigEndian.AppendUint16(nil, uint16(len(segment.data)+2)))
+		bw.Write(segment.data)
+	}
+
+	_, err = io.Copy(bw, br)
+	if err != nil {
+		return errors.Wrap(err, "strip exif")
+	}
+	err = bw.Flush()
+	if err != nil {
+		return errors.Wrap(err, "strip exif")
+	}
+	return nil
+}
+
+// tiff is the structure of the EXIF. Its offsets are relative to its start.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// pos is where the value is, either in the entry or out of it.
+	pos int
+}
+
+func newTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff too short")
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid tiff byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, errors.New("invalid tiff magic")
+	}
+	return &t, nil
+}
+
+func (t *tiff) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:])
+}
+
+// ifd reads the entries of the IFD at the offset. The entries, whose values
+// are out of the data, are skipped.
+func (t *tiff) ifd(offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errors.New("ifd out of range", "offset", offset)
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	if n > maxIFDEntries || int(offset)+2+n*12 > len(t.data) {
+		return nil, errors.New("ifd out of range", "offset", offset)
+	}
+
+	entries := make([]tiffEntry, 0, n)
+	for i := range n {
+		entryPos := int(offset) + 2 + i*12
+		entry := tiffEntry{
+			tag:   t.order.Uint16(t.data[entryPos:]),
+			typ:   t.order.Uint16(t.data[entryPos+2:]),
+			count: t.order.Uint32(t.data[entryPos+4:]),
+			pos:   entryPos + 8,
+		}
+		size := entry.size()
+		if size < 0 {
+			continue
+		}
+		if size > 4 {
+			entry.pos = int(t.order.Uint32(t.data[entryPos+8:]))
+		}
+		if int64(entry.pos)+size > int64(len(t.data)) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// size is the length of the value in bytes, it is -1 for an unknown type.
+func (e tiffEntry) size() int64 {
+	var unit int64
+	switch e.typ {
+	case 1, 2, 6, 7:
+		unit = 1
+	case 3, 8:
+		unit = 2
+	case 4, 9, 11, 13:
+		unit = 4
+	case 5, 10, 12:
+		unit = 8
+	default:
+		return -1
+	}
+	return unit * int64(e.count)
+}
+
+func (t *tiff) ascii(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	value := t.data[e.pos : e.pos+int(e.count)]
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+func (t *tiff) uint(e tiffEntry) (uint32, bool) {
+	if e.count < 1 {
+		return 0, false
+	}
+	switch e.typ {
+	case 3:
+		return uint32(t.order.Uint16(t.data[e.pos:])), true
+	case 4, 13:
+		return t.order.Uint32(t.data[e.pos:]), true
+	}
+	return 0, false
+}
+
+func (t *tiff) rational(e tiffEntry, i int) (uint32, uint32, bool) {
+	if e.typ != 5 || uint32(i) >= e.count {
+		return 0, 0, false
+	}
+	pos := e.pos + i*8
+	num, den := t.order.Uint32(t.data[pos:]), t.order.Uint32(t.data[pos+4:])
+	return num, den, den != 0
+}
+
+func (t *tiff) float(e tiffEntry) float64 {
+	num, den, ok := t.rational(e, 0)
+	if !ok {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*100) / 100
+}
+
+// subIFD follows the pointer of the tag, e.g. to the Exif IFD.
+func (t *tiff) subIFD(entries []tiffEntry, tag uint16) (uint32, []tiffEntry) {
+	for _, e := range entries {
+		if e.tag != tag {
+			continue
+		}
+		offset, ok := t.uint(e)
+		if !ok {
+			return 0, nil
+		}
+		sub, err := t.ifd(offset)
+		if err != nil {
+			return 0, nil
+		}
+		return offset, sub
+	}
+	return 0, nil
+}
+
+func (t *tiff) exif() EXIF {
+	var exif EXIF
+	ifd0, err := t.ifd(t.firstIFD())
+	if err != nil {
+		return exif
+	}
+
+	var dateTime, dateTimeOriginal, offsetTime string
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			exif.Make = t.ascii(e)
+		case tagModel:
+			exif.Model = t.ascii(e)
+		case tagOrientation:
+			orientation, ok := t.uint(e)
+			if ok && orientation >= 1 && orientation <= 8 {
+				exif.Orientation = int(orientation)
+			}
+		case tagDateTime:
+			dateTime = t.ascii(e)
+		}
+	}
+
+	_, exifIFD := t.subIFD(ifd0, tagExifIFD)
+	for _, e := range exifIFD {
+		switch e.tag {
+		case tagExposureTime:
+			num, den, ok := t.rational(e, 0)
+			if ok && num > 0 {
+				exif.ExposureTime = exposureTime(num, den)
+			}
+		case tagFNumber:
+			exif.FNumber = t.float(e)
+		case tagISO:
+			iso, ok := t.uint(e)
+			if ok {
+				exif.ISO = int(iso)
+			}
+		case tagDateTimeOriginal:
+			dateTimeOriginal = t.ascii(e)
+		case tagOffsetTimeOriginal:
+			offsetTime = t.ascii(e)
+		case tagFocalLength:
+			exif.FocalLength = t.float(e)
+		case tagLensModel:
+			exif.Lens = t.ascii(e)
+		}
+	}
+
+	if dateTimeOriginal == "" {
+		dateTimeOriginal, offsetTime = dateTime, ""
+	}
+	exif.TakenAt = exifTime(dateTimeOriginal, offsetTime)
+
+	_, gpsIFD := t.subIFD(ifd0, tagGPSIFD)
+	var latRef, lonRef string
+	var lat, lon *float64
+	for _, e := range gpsIFD {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.ascii(e)
+		case tagGPSLatitude:
+			lat = t.degrees(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.ascii(e)
+		case tagGPSLongitude:
+			lon = t.degrees(e)
+		}
+	}
+	if lat != nil && lon != nil {
+		if latRef == "S" {
+			*lat = -*lat
+		}
+		if lonRef == "W" {
+			*lon = -*lon
+		}
+		exif.Latitude, exif.Longitude = lat, lon
+	}
+	return exif
+}
+
+// degrees converts the degrees, minutes, and seconds of the GPS.
+func (t *tiff) degrees(e tiffEntry) *float64 {
+	var value float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den, ok := t.rational(e, i)
+		if !ok {
+			return nil
+		}
+		value += float64(num) / float64(den) / unit
+	}
+	return &value
+}
+
+// blankPrivateTags zeroes the GPS IFD, and the values of the private tags of
+// the Exif IFD. The GPS IFD is left there with no entries, so its pointer
+// stays valid. It fails, if it cannot read every entry, which may have to be
+// blanked, so the caller can drop the whole EXIF.
+func (t *tiff) blankPrivateTags() error {
+	ifd0, err := t.strictIFD(t.firstIFD())
+	if err != nil {
+		return errors.Wrap(err, "blank private tags")
+	}
+
+	// Note: every pointer is followed, a forged file may have more of them.
+	for _, e := range ifd0 {
+		if e.tag != tagExifIFD && e.tag != tagGPSIFD {
+			continue
+		}
+		offset, ok := t.uint(e)
+		if !ok {
+			return errors.New("blank private tags: invalid ifd pointer", "tag", e.tag)
+		}
+		entries, err := t.strictIFD(offset)
+		if err != nil {
+			return errors.Wrap(err, "blank private tags", "tag", e.tag)
+		}
+
+		if e.tag == tagExifIFD {
+			for _, entry := range entries {
+				if privateEXIFTags[entry.tag] {
+					t.blank(entry)
+				}
+			}
+			continue
+		}
+		for _, entry := range entries {
+			t.blank(entry)
+		}
+		clear(t.data[offset:min(int(offset)+2+len(entries)*12+4, len(t.data))])
+	}
+	return nil
+}
+
+// strictIFD reads the entries of the IFD as ifd does, but it fails instead of
+// skipping an entry.
+func (t *tiff) strictIFD(offset uint32) ([]tiffEntry, error) {
+	entries, err := t.ifd(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != int(t.order.Uint16(t.data[offset:])) {
+		return nil, errors.New("ifd has unreadable entries", "offset", offset)
+	}
+	return entries, nil
+}
+
+func (t *tiff) blank(e tiffEntry) {
+	clear(t.data[e.pos : e.pos+int(e.size())])
+}
+
+func exposureTime(num, den uint32) string {
+	if num < den {
+		return fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+	}
+	return fmt.Sprintf("%g", math.Round(float64(num)/float64(den)*10)/10)
+}
+
+// exifTime parses the local time of the camera. Without the offset the time
+// zone is unknown, so it is taken as UTC.
+func exifTime(value, offset string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(exifDateLayout+"-07:00", value+offset)
+	if err != nil {
+		t, err = time.Parse(exifDateLayout, value)
+		if err != nil {
+			return nil
+		}
+	}
+	return &t
+}
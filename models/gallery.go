@@ -1,52 +1,93 @@
 package models
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"io/fs"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"fmt"
 
 	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/storage"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	galleriesCountForOptimization = 5
 	imagesCountForOptimization    = 20
+
+	// MaxImagePixels limits the decoded size of the images, because a small
+	// file can claim huge dimensions, which would take gigabytes to decode.
+	MaxImagePixels = 50_000_000
+
+	IssueTooManyPixels = "too many pixels"
 )
 
+// Image is stored in the storage under StorageKey. The StorageKey is
+// "gallery-<ID>/<Filename>", so the files of the time before the images table
+// are found where they are. The Width and the Height are upright, i.e. they are
+// swapped by the EXIF orientation.
 type Image struct {
-	GalleryID int
-	Path      string
-	Filename  string
+	ID          int
+	GalleryID   int
+	Filename    string
+	StorageKey  string
+	Size        int64
+	ContentType string
+	Width       int
+	Height      int
+	Checksum    string
+	UploadedAt  time.Time
+	EXIF        EXIF
 }
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// StripMetadata removes the location and the serial numbers from the
+	// served originals, it is on by default.
+	StripMetadata bool
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
-	ImagesDir string
+	// Storage keeps the images, it is the images dir by default.
+	Storage storage.Storage
+
+	// Limits restrict the uploads of a user, see UploadLimits.
+	Limits UploadLimits
+
+	renditionsOnce  sync.Once
+	renditionQueue  chan Image
+	renditionFlight singleflight.Group
 }
 
 func (g *GalleryService) Create(ctx context.Context, title string, userID int) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:         title,
+		UserID:        userID,
+		StripMetadata: true,
 	}
 
 	row := g.DB.QueryRowContext(ctx, `
-    INSERT INTO galleries (title, user_id)
-    VALUES ($1, $2) RETURNING id;`,
-		gallery.Title, gallery.UserID)
+    INSERT INTO galleries (title, user_id, strip_metadata)
+    VALUES ($1, $2, $3) RETURNING id;`,
+		gallery.Title, gallery.UserID, gallery.StripMetadata)
 	err := row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, errors.Wrap(err, "create gallery", "title", title, "user ID", userID)
@@ -61,11 +102,12 @@ func (g *GalleryService) ByID(ctx context.Context, id int) (*Gallery, error) {
 	}
 
 	row := g.DB.QueryRowContext(ctx, `
-    SELECT title, user_id
+    SELECT galleries.title, galleries.user_id, galleries.strip_metadata
     FROM galleries
-    WHERE id = $1;`,
+      JOIN users ON users.id = galleries.user_id
+    WHERE galleries.id = $1 AND users.deleted_at IS NULL;`,
 		gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.StripMetadata)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			err = ErrNotFound
@@ -77,7 +119,7 @@ func (g *GalleryService) ByID(ctx context.Context, id int) (*Gallery, error) {
 
 func (g *GalleryService) ByUserID(ctx context.Context, userID int) ([]Gallery, error) {
 	rows, err := g.DB.QueryContext(ctx, `
-    SELECT id, title
+    SELECT id, title, strip_metadata
     FROM galleries
     WHERE user_id = $1;`,
 		userID)
@@ -90,7 +132,7 @@ func (g *GalleryService) ByUserID(ctx context.Context, userID int) ([]Gallery, e
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err = rows.Scan(&gallery.ID, &gallery.Title)
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.StripMetadata)
 		if err != nil {
 			return nil, errors.Wrap(err, "gallery by user ID", "user ID", userID)
 		}
@@ -105,9 +147,9 @@ func (g *GalleryService) ByUserID(ctx context.Context, userID int) ([]Gallery, e
 func (g *GalleryService) Update(ctx context.Context, gallery *Gallery) error {
 	_, err := g.DB.ExecContext(ctx, `
     UPDATE galleries
-    SET title = $2
+    SET title = $2, strip_metadata = $3
     WHERE id = $1;`,
-		gallery.ID, gallery.Title)
+		gallery.ID, gallery.Title, gallery.StripMetadata)
 	if err != nil {
 		return errors.Wrap(err, "update gallery", "title", gallery.Title)
 	}
@@ -115,100 +157,363 @@ func (g *GalleryService) Update(ctx context.Context, gallery *Gallery) error {
 }
 
 func (g *GalleryService) Delete(ctx context.Context, id int) error {
-	_, err := g.DB.ExecContext(ctx, `
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "delete gallery", "ID", id)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE users
+    SET storage_used = GREATEST(0, storage_used - (
+      SELECT COALESCE(SUM(size), 0)
+      FROM images
+      WHERE gallery_id = $1
+    ))
+    WHERE id = (SELECT user_id FROM galleries WHERE id = $1);`, id)
+	if err != nil {
+		return errors.Wrap(err, "delete gallery", "ID", id)
+	}
+
+	_, err = tx.ExecContext(ctx, `
     DELETE FROM galleries
     WHERE id = $1;`, id)
 	if err != nil {
 		return errors.Wrap(err, "delete gallery", "ID", id)
 	}
 
-	err = os.RemoveAll(g.galleryDir(id))
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "delete gallery", "ID", id)
+	}
+
+	objects, err := g.storage().List(ctx, galleryPrefix(id))
 	if err != nil {
 		return errors.Wrap(err, "delete gallery", "ID", id)
 	}
+	for _, object := range objects {
+		err = g.storage().Delete(ctx, object.Key)
+		if err != nil {
+			return errors.Wrap(err, "delete gallery", "ID", id)
+		}
+	}
 	return nil
 }
 
-func (g *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(g.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+func (g *GalleryService) Images(ctx context.Context, galleryID int) ([]Image, error) {
+	rows, err := g.DB.QueryContext(ctx, `
+    SELECT images.id, images.filename, images.storage_key, images.size, images.content_type, images.width,
+      images.height, images.checksum, images.uploaded_at, images.exif
+    FROM images
+      JOIN galleries ON galleries.id = images.gallery_id
+      JOIN users ON users.id = galleries.user_id
+    WHERE images.gallery_id = $1 AND users.deleted_at IS NULL
+    ORDER BY images.uploaded_at, images.id;`,
+		galleryID)
 	if err != nil {
 		return nil, errors.Wrap(err, "retrieve images", "gallery ID", galleryID)
 	}
+	defer rows.Close()
 
 	images := make([]Image, 0, imagesCountForOptimization)
-	for _, file := range allFiles {
-		if hasExtension(file, g.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+		var exif []byte
+		err = rows.Scan(&image.ID, &image.Filename, &image.StorageKey, &image.Size, &image.ContentType,
+			&image.Width, &image.Height, &image.Checksum, &image.UploadedAt, &exif)
+		if err != nil {
+			return nil, errors.Wrap(err, "retrieve images", "gallery ID", galleryID)
+		}
+		err = json.Unmarshal(exif, &image.EXIF)
+		if err != nil {
+			return nil, errors.Wrap(err, "retrieve images", "gallery ID", galleryID, "ID", image.ID)
 		}
+		images = append(images, image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "retrieve images", "gallery ID", galleryID)
 	}
 	return images, nil
 }
 
-func (g *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(g.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+func (g *GalleryService) Image(ctx context.Context, galleryID int, filename string) (*Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+
+	row := g.DB.QueryRowContext(ctx, `
+    SELECT images.id, images.storage_key, images.size, images.content_type, images.width, images.height,
+      images.checksum, images.uploaded_at, images.exif
+    FROM images
+      JOIN galleries ON galleries.id = images.gallery_id
+      JOIN users ON users.id = galleries.user_id
+    WHERE images.gallery_id = $1 AND images.filename = $2 AND users.deleted_at IS NULL;`,
+		galleryID, filename)
+	var exif []byte
+	err := row.Scan(&image.ID, &image.StorageKey, &image.Size, &image.ContentType,
+		&image.Width, &image.Height, &image.Checksum, &image.UploadedAt, &exif)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return Image{}, fmt.Errorf("retrieve an image: %w gallery ID: %v, filename: %v", ErrNotFound, galleryID, filename)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
 		}
-		return Image{}, fmt.Errorf("retrieve an image: %w gallery ID: %v, filename: %v", err, galleryID, filename)
+		return nil, errors.Wrap(err, "retrieve an image", "gallery ID", galleryID, "filename", filename)
 	}
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+	err = json.Unmarshal(exif, &image.EXIF)
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieve an image", "gallery ID", galleryID, "filename", filename)
+	}
+	return &image, nil
 }
 
-func (g *GalleryService) CreateImage(galleryID int, filename string, content io.ReadSeeker) error {
-	err := checkContentType(content, g.imageContentTypes())
+// CreateImage replaces the image with the same filename in the gallery. The
+// object is stored in the transaction of the row, so a failed upload leaves
+// neither of them behind.
+func (g *GalleryService) CreateImage(ctx context.Context, galleryID int, filename string, content io.ReadSeeker) (*Image, error) {
+	filename = filepath.Base(filename)
+	image := Image{
+		GalleryID:  galleryID,
+		Filename:   filename,
+		StorageKey: imageStorageKey(galleryID, filename),
+	}
+
+	err := checkExtension(filename, g.extensions())
 	if err != nil {
-		return errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
 	}
 
-	err = checkExtension(filename, g.extensions())
+	err = inspectImage(content, g.imageContentTypes(), &image)
 	if err != nil {
-		return errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
 	}
 
-	galleryDir := g.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	hash := sha256.New()
+	image.Size, err = io.Copy(hash, content)
 	if err != nil {
-		return errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
 	}
+	image.Checksum = hex.EncodeToString(hash.Sum(nil))
 
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	err = g.checkFileSize(&image)
 	if err != nil {
-		return errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, content)
+	_, err = content.Seek(0, io.SeekStart)
 	if err != nil {
-		return errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
 	}
-	return nil
+
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+	}
+	defer tx.Rollback()
+
+	err = g.reserveStorage(ctx, tx, &image)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	err = insertImage(ctx, tx, &image)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	err = g.storage().Put(ctx, image.StorageKey, content, image.Size, image.ContentType)
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "create image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	g.queueRenditions(&image)
+	return &image, nil
 }
 
-func (g *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := g.Image(galleryID, filename)
+func (g *GalleryService) DeleteImage(ctx context.Context, galleryID int, filename string) error {
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
+	}
+	defer tx.Rollback()
+
+	var storageKey string
+	var size int64
+	var userID int
+	row := tx.QueryRowContext(ctx, `
+    DELETE FROM images
+    USING galleries
+    WHERE images.gallery_id = $1 AND images.filename = $2 AND galleries.id = images.gallery_id
+    RETURNING images.storage_key, images.size, galleries.user_id;`,
+		galleryID, filename)
+	err = row.Scan(&storageKey, &size, &userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	err = addStorageUsed(ctx, tx, userID, -size)
+	if err != nil {
+		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	// Note: the objects are deleted only after the commit, so a failed delete leaves at most orphan objects behind,
+	// never a row without its object.
+	image := Image{
+		GalleryID:  galleryID,
+		Filename:   filename,
+		StorageKey: storageKey,
+	}
+	err = g.deleteRenditions(ctx, &image)
 	if err != nil {
 		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
 	}
 
-	err = os.Remove(image.Path)
+	err = g.storage().Delete(ctx, storageKey)
 	if err != nil {
 		return errors.Wrap(err, "delete image", "gallery ID", galleryID, "filename", filename)
 	}
 	return nil
 }
 
+// ImportFiles creates the missing rows of the image objects in the gallery
+// dirs, which were uploaded before the images table. The objects, which are
+// not valid images, are skipped and their keys are returned. It can be run
+// repeatedly.
+func (g *GalleryService) ImportFiles(ctx context.Context) (int, []string, error) {
+	rows, err := g.DB.QueryContext(ctx, `
+    SELECT id
+    FROM galleries;`)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "import image files")
+	}
+	defer rows.Close()
+
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "import image files")
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, errors.Wrap(err, "import image files")
+	}
+
+	imported := 0
+	var skipped []string
+	for _, galleryID := range galleryIDs {
+		objects, err := g.storage().List(ctx, galleryPrefix(galleryID))
+		if err != nil {
+			return imported, skipped, errors.Wrap(err, "import image files", "gallery ID", galleryID)
+		}
+
+		for _, object := range objects {
+			// Note: the renditions are in sub dirs.
+			if path.Dir(object.Key)+"/" != galleryPrefix(galleryID) || !hasExtension(object.Key, g.extensions()) {
+				continue
+			}
+
+			ok, err := g.importFile(ctx, galleryID, object)
+			if err != nil {
+				var fileErr FileError
+				if !errors.As(err, &fileErr) {
+					return imported, skipped, errors.Wrap(err, "import image files", "gallery ID", galleryID)
+				}
+				skipped = append(skipped, object.Key)
+				continue
+			}
+			if ok {
+				imported++
+			}
+		}
+	}
+	return imported, skipped, nil
+}
+
+func (g *GalleryService) importFile(ctx context.Context, galleryID int, object storage.Object) (bool, error) {
+	image := Image{
+		GalleryID:  galleryID,
+		Filename:   path.Base(object.Key),
+		StorageKey: object.Key,
+		UploadedAt: object.ModTime,
+	}
+
+	r, _, err := g.storage().Get(ctx, object.Key)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+	defer r.Close()
+
+	// Note: the uploads were limited to 5 MB, so the images fit into the memory.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+	image.Size = int64(len(data))
+	checksum := sha256.Sum256(data)
+	image.Checksum = hex.EncodeToString(checksum[:])
+
+	err = inspectImage(bytes.NewReader(data), g.imageContentTypes(), &image)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+
+	exif, err := json.Marshal(image.EXIF)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+	defer tx.Rollback()
+
+	// Note: the quota is not checked, the images are there already.
+	var userID int
+	row := tx.QueryRowContext(ctx, `
+    INSERT INTO images (gallery_id, filename, storage_key, size, content_type, width, height, checksum, uploaded_at, exif)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+    ON CONFLICT DO NOTHING
+    RETURNING (SELECT user_id FROM galleries WHERE id = $1);`,
+		image.GalleryID, image.Filename, image.StorageKey, image.Size, image.ContentType,
+		image.Width, image.Height, image.Checksum, image.UploadedAt, exif)
+	err = row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+
+	err = addStorageUsed(ctx, tx, userID, image.Size)
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "import image file", "key", object.Key)
+	}
+	return true, nil
+}
+
 func (g *GalleryService) imageContentTypes() []string {
 	return []string{"image/png", "image/jpeg", "image/gif"}
 }
@@ -217,12 +522,82 @@ func (g *GalleryService) extensions() []string {
 	return []string{".png", ".jpg", ".jpeg", ".gif"}
 }
 
-func (g *GalleryService) galleryDir(id int) string {
-	imagesDir := g.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+func (g *GalleryService) storage() storage.Storage {
+	if g.Storage == nil {
+		return &storage.Local{}
+	}
+	return g.Storage
+}
+
+func galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d/", id)
+}
+
+func imageStorageKey(galleryID int, filename string) string {
+	return galleryPrefix(galleryID) + filename
+}
+
+// insertImage replaces the row of the same filename, and it fills the ID and
+// the time of the upload.
+func insertImage(ctx context.Context, tx *sql.Tx, image *Image) error {
+	exif, err := json.Marshal(image.EXIF)
+	if err != nil {
+		return errors.Wrap(err, "insert image", "gallery ID", image.GalleryID, "filename", image.Filename)
+	}
+
+	row := tx.QueryRowContext(ctx, `
+    INSERT INTO images (gallery_id, filename, storage_key, size, content_type, width, height, checksum, exif)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    ON CONFLICT (gallery_id, filename) DO UPDATE
+    SET size = EXCLUDED.size, content_type = EXCLUDED.content_type, width = EXCLUDED.width,
+      height = EXCLUDED.height, checksum = EXCLUDED.checksum, exif = EXCLUDED.exif, uploaded_at = NOW()
+    RETURNING id, uploaded_at;`,
+		image.GalleryID, image.Filename, image.StorageKey, image.Size, image.ContentType,
+		image.Width, image.Height, image.Checksum, exif)
+	err = row.Scan(&image.ID, &image.UploadedAt)
+	if err != nil {
+		return errors.Wrap(err, "insert image", "gallery ID", image.GalleryID, "filename", image.Filename)
+	}
+	return nil
+}
+
+// inspectImage fills the content type, the dimensions, and the EXIF of the
+// JPEGs, and rewinds the content.
+func inspectImage(content io.ReadSeeker, allowedTypes []string, img *Image) error {
+	contentType, err := checkContentType(content, allowedTypes)
+	if err != nil {
+		return errors.Wrap(err, "inspect image")
+	}
+
+	config, _, err := image.DecodeConfig(content)
+	if err != nil {
+		return errors.Wrap(FileError{Issue: "undecodable image"}, "inspect image", "error", err.Error())
+	}
+	if int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return errors.Wrap(FileError{Issue: IssueTooManyPixels}, "inspect image", "width", config.Width, "height", config.Height)
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "inspect image")
+	}
+
+	img.ContentType = contentType
+	img.Width = config.Width
+	img.Height = config.Height
+
+	if contentType == "image/jpeg" {
+		img.EXIF = parseEXIF(content)
+		if img.EXIF.swapsAxes() {
+			img.Width, img.Height = img.Height, img.Width
+		}
+
+		_, err = content.Seek(0, io.SeekStart)
+		if err != nil {
+			return errors.Wrap(err, "inspect image")
+		}
+	}
+	return nil
 }
 
 func hasExtension(file string, extensions []string) bool {
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/szykes/simple-backend/errors"
+)
+
+// Identity links an account of an external OpenID Connect provider to a
+// user.
+type Identity struct {
+	ID        int
+	UserID    int
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+type NewIdentityUser struct {
+	Name           string
+	Email          string
+	EmailVerified  bool
+	Provider       string
+	Subject        string
+	InvitationCode string
+}
+
+type IdentityService struct {
+	DB           *sql.DB
+	Registration *RegistrationPolicy
+}
+
+// User returns the user linked to the external identity.
+func (i *IdentityService) User(ctx context.Context, provider, subject string) (*User, error) {
+	var user User
+	row := i.DB.QueryRowContext(ctx, `
+    SELECT users.id, users.name, users.email, users.password_hash,
+      users.email_verified_at, users.totp_enabled_at, users.deleted_at
+    FROM identities
+      JOIN users ON users.id = identities.user_id
+    WHERE identities.provider = $1 AND identities.subject = $2;`,
+		provider, subject)
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash,
+		&user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.DeletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "identity user", "provider", provider)
+	}
+	return &user, nil
+}
+
+// UserByEmail returns the user of the email, so an external identity with a
+// verified email can be linked to an existing account.
+func (i *IdentityService) UserByEmail(ctx context.Context, email string) (*User, error) {
+	user := User{
+		Email: strings.ToLower(email),
+	}
+	row := i.DB.QueryRowContext(ctx, `
+    SELECT id, name, password_hash, email_verified_at, totp_enabled_at, deleted_at
+    FROM users
+    WHERE email = $1;`,
+		user.Email)
+	err := row.Scan(&user.ID, &user.Name, &user.PasswordHash,
+		&user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.DeletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "identity user by email")
+	}
+	return &user, nil
+}
+
+// CreateUser creates a user without password and links the external identity
+// to it.
+func (i *IdentityService) CreateUser(ctx context.Context, newUser NewIdentityUser) (*User, error) {
+	user := User{
+		Name:  newUser.Name,
+		Email: strings.ToLower(newUser.Email),
+	}
+
+	err := i.Registration.Check(user.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+	}
+	// Note: the domain of an unverified email tells nothing about the user.
+	if i.Registration != nil && i.Registration.Mode == RegistrationDomains && !newUser.EmailVerified {
+		return nil, errors.Wrap(ErrDomainNotAllowed, "create identity user", "provider", newUser.Provider)
+	}
+
+	tx, err := i.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+    INSERT INTO users (name, email, password_hash, email_verified_at)
+    VALUES ($1, $2, '', CASE WHEN $3 THEN NOW() END)
+    RETURNING id, email_verified_at;`,
+		user.Name, user.Email, newUser.EmailVerified)
+	err = row.Scan(&user.ID, &user.EmailVerifiedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			err = ErrEmailTaken
+		}
+		return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+	}
+
+	err = link(ctx, tx, user.ID, newUser.Provider, newUser.Subject, user.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+	}
+
+	if i.Registration.InviteOnly() {
+		err = redeemInvitation(ctx, tx, newUser.InvitationCode, user.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "create identity user", "provider", newUser.Provider)
+	}
+	return &user, nil
+}
+
+func (i *IdentityService) Link(ctx context.Context, userID int, provider, subject, email string) error {
+	err := link(ctx, i.DB, userID, provider, subject, strings.ToLower(email))
+	if err != nil {
+		return errors.Wrap(err, "link identity", "user ID", userID)
+	}
+	return nil
+}
+
+func (i *IdentityService) ByUserID(ctx context.Context, userID int) ([]Identity, error) {
+	rows, err := i.DB.QueryContext(ctx, `
+    SELECT id, provider, subject, email, created_at
+    FROM identities
+    WHERE user_id = $1
+    ORDER BY created_at;`,
+		userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "identities by user ID", "user ID", userID)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "identities by user ID", "user ID", userID)
+		}
+		identities = append(identities, identity)
+	}
+	if rows.Err() != nil {
+		return nil, errors.Wrap(rows.Err(), "identities by user ID", "user ID", userID)
+	}
+	return identities, nil
+}
+
+// Unlink removes the identity of the user, unless the user could not sign in
+// anymore without it.
+func (i *IdentityService) Unlink(ctx context.Context, userID, id int) error {
+	result, err := i.DB.ExecContext(ctx, `
+    DELETE FROM identities
+    WHERE id = $2 AND user_id = $1 AND (
+      EXISTS (SELECT 1 FROM users WHERE id = $1 AND password_hash <> '')
+      OR EXISTS (SELECT 1 FROM identities WHERE user_id = $1 AND id <> $2));`,
+		userID, id)
+	if err != nil {
+		return errors.Wrap(err, "unlink identity", "user ID", userID, "ID", id)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unlink identity", "user ID", userID, "ID", id)
+	}
+	if n == 0 {
+		var exists bool
+		row := i.DB.QueryRowContext(ctx, `
+      SELECT EXISTS (SELECT 1 FROM identities WHERE id = $2 AND user_id = $1);`,
+			userID, id)
+		err = row.Scan(&exists)
+		if err != nil {
+			return errors.Wrap(err, "unlink identity", "user ID", userID, "ID", id)
+		}
+		if exists {
+			return errors.Wrap(ErrLastSignInMethod, "unlink identity", "user ID", userID, "ID", id)
+		}
+		return errors.Wrap(ErrNotFound, "unlink identity", "user ID", userID, "ID", id)
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func link(ctx context.Context, db execer, userID int, provider, subject, email string) error {
+	_, err := db.ExecContext(ctx, `
+    INSERT INTO identities (user_id, provider, subject, email)
+    VALUES ($1, $2, $3, $4);`,
+		userID, provider, subject, email)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			err = ErrIdentityTaken
+		}
+		return errors.Wrap(err, "link identity", "provider", provider)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	DefaultInvitationDuration = 7 * 24 * time.Hour
+	// MaxPendingInvitations limits the unused invitations of the non-admin users.
+	MaxPendingInvitations = 10
+)
+
+type Invitation struct {
+	ID        int
+	CreatedBy int
+	Code      string // set only when creating a new invitation
+	CodeHash  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedBy    string // the email of the new user, set only when listing the invitations
+}
+
+func (i *Invitation) Used() bool {
+	return i.UsedAt != nil
+}
+
+type InvitationService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (i *InvitationService) Create(ctx context.Context, creator *User) (*Invitation, error) {
+	bytesPerToken := max(i.BytesPerToken, MinBytesPerToken)
+	code, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "create invitation", "user ID", creator.ID)
+	}
+
+	duration := i.Duration
+	if duration == 0 {
+		duration = DefaultInvitationDuration
+	}
+	invitation := Invitation{
+		CreatedBy: creator.ID,
+		Code:      code,
+		CodeHash:  hashInvitationCode(code),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	limit := MaxPendingInvitations
+	if creator.HasRole(RoleAdmin) {
+		limit = -1
+	}
+	row := i.DB.QueryRowContext(ctx, `
+    INSERT INTO invitations (created_by, code_hash, expires_at)
+    SELECT $1, $2, $3
+    WHERE $4 < 0 OR (
+      SELECT COUNT(*) FROM invitations
+      WHERE created_by = $1 AND used_at IS NULL AND expires_at > NOW()) < $4
+    RETURNING id, created_at;`,
+		invitation.CreatedBy, invitation.CodeHash, invitation.ExpiresAt, limit)
+	err = row.Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrTooManyInvitations
+		}
+		return nil, errors.Wrap(err, "create invitation", "user ID", creator.ID)
+	}
+	return &invitation, nil
+}
+
+func (i *InvitationService) ByCreator(ctx context.Context, userID int) ([]Invitation, error) {
+	rows, err := i.DB.QueryContext(ctx, `
+    SELECT invitations.id, invitations.created_at, invitations.expires_at, invitations.used_at,
+      COALESCE(users.email, '')
+    FROM invitations
+    LEFT JOIN users ON users.id = invitations.used_by
+    WHERE invitations.created_by = $1
+    ORDER BY invitations.created_at DESC;`,
+		userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "invitations by creator", "user ID", userID)
+	}
+	defer rows.Close()
+
+	var invitations []Invitation
+	for rows.Next() {
+		invitation := Invitation{
+			CreatedBy: userID,
+		}
+		err = rows.Scan(&invitation.ID, &invitation.CreatedAt, &invitation.ExpiresAt, &invitation.UsedAt, &invitation.UsedBy)
+		if err != nil {
+			return nil, errors.Wrap(err, "invitations by creator", "user ID", userID)
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "invitations by creator", "user ID", userID)
+	}
+	return invitations, nil
+}
+
+// Delete revokes the unused invitation.
+func (i *InvitationService) Delete(ctx context.Context, userID, id int) error {
+	result, err := i.DB.ExecContext(ctx, `
+    DELETE FROM invitations
+    WHERE id = $1 AND created_by = $2 AND used_at IS NULL;`,
+		id, userID)
+	if err != nil {
+		return errors.Wrap(err, "delete invitation", "user ID", userID, "ID", id)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "delete invitation", "user ID", userID, "ID", id)
+	}
+	if affected == 0 {
+		return errors.Wrap(ErrNotFound, "delete invitation", "user ID", userID, "ID", id)
+	}
+	return nil
+}
+
+// redeemInvitation uses up the invitation for the new user. It is called in
+// the transaction creating the user, so the user is not created if the code
+// is invalid.
+func redeemInvitation(ctx context.Context, db execer, code string, userID int) error {
+	if code == "" {
+		return errors.Wrap(ErrInvalidInvitation, "redeem invitation", "user ID", userID)
+	}
+
+	result, err := db.ExecContext(ctx, `
+    UPDATE invitations
+    SET used_by = $2, used_at = NOW()
+    WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW();`,
+		hashInvitationCode(code), userID)
+	if err != nil {
+		return errors.Wrap(err, "redeem invitation", "user ID", userID)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "redeem invitation", "user ID", userID)
+	}
+	if affected == 0 {
+		return errors.Wrap(ErrInvalidInvitation, "redeem invitation", "user ID", userID)
+	}
+	return nil
+}
+
+func hashInvitationCode(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
@@ -37,7 +37,7 @@ func (p *PasswordResetService) Create(ctx context.Context, email string) (*Passw
 	row := p.DB.QueryRowContext(ctx, `
     SELECT id
     FROM users
-    WHERE email = $1;
+    WHERE email = $1 AND deleted_at IS NULL;
 `, email)
 	err := row.Scan(&userID)
 	if err != nil {
@@ -78,7 +78,33 @@ func (p *PasswordResetService) Create(ctx context.Context, email string) (*Passw
 	return &pwReset, nil
 }
 
+// User returns the user of a valid token without consuming it.
+func (p *PasswordResetService) User(ctx context.Context, token string) (*User, error) {
+	user, _, err := p.lookup(ctx, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "pwd reset user")
+	}
+	return user, nil
+}
+
 func (p *PasswordResetService) Consume(ctx context.Context, token string) (*User, error) {
+	user, pwReset, err := p.lookup(ctx, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "pwd reset consume")
+	}
+
+	_, err = p.DB.ExecContext(ctx, `
+    DELETE FROM password_resets
+    WHERE id = $1;`,
+		pwReset.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "pwd reset consume")
+	}
+
+	return user, nil
+}
+
+func (p *PasswordResetService) lookup(ctx context.Context, token string) (*User, *PasswordReset, error) {
 	tokenHash := p.hash(token)
 	var user User
 	var pwReset PasswordReset
@@ -86,30 +112,29 @@ func (p *PasswordResetService) Consume(ctx context.Context, token string) (*User
     SELECT password_resets.id,
       password_resets.expires_at,
       users.id,
+      users.name,
       users.email,
-      users.password_hash
+      users.password_hash,
+      users.email_verified_at,
+      users.totp_enabled_at
     FROM password_resets
       JOIN users ON users.id = password_resets.user_id
     WHERE password_resets.token_hash = $1;`,
 		tokenHash)
-	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Name, &user.Email, &user.PasswordHash,
+		&user.EmailVerifiedAt, &user.TOTPEnabledAt)
 	if err != nil {
-		return nil, errors.Wrap(err, "pwd reset consume")
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, nil, errors.Wrap(err, "pwd reset lookup")
 	}
 
 	if time.Now().After(pwReset.ExpiresAt) {
-		return nil, errors.Wrap(errors.New("token expired"), "pwd reset consume", "token", token)
-	}
-
-	_, err = p.DB.ExecContext(ctx, `
-    DELETE FROM password_resets
-    WHERE id = $1;`,
-		pwReset.ID)
-	if err != nil {
-		return nil, errors.Wrap(err, "pwd reset consume")
+		return nil, nil, errors.Wrap(ErrTokenExpired, "pwd reset lookup", "user ID", user.ID)
 	}
 
-	return &user, nil
+	return &user, &pwReset, nil
 }
 
 func (p *PasswordResetService) hash(token string) string {
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	DefaultMaxFileSize         = 5 << 20 // 5 MB
+	DefaultMaxImagesPerGallery = 100
+	DefaultStorageQuota        = 100 << 20 // 100 MB
+)
+
+// UploadLimits are the same for every user. The zero values mean the
+// defaults. Only the originals count into the storage quota, the renditions
+// do not.
+type UploadLimits struct {
+	MaxFileSize         int64
+	MaxImagesPerGallery int
+	StorageQuota        int64
+}
+
+// StorageUsage is shown to the users as a meter.
+type StorageUsage struct {
+	Used  int64
+	Quota int64
+}
+
+func (s StorageUsage) Percent() int {
+	if s.Quota <= 0 {
+		return 0
+	}
+	return int(min(100, s.Used*100/s.Quota))
+}
+
+func (s StorageUsage) UsedText() string {
+	return formatBytes(s.Used)
+}
+
+func (s StorageUsage) QuotaText() string {
+	return formatBytes(s.Quota)
+}
+
+func (g *GalleryService) MaxFileSize() int64 {
+	if g.Limits.MaxFileSize <= 0 {
+		return DefaultMaxFileSize
+	}
+	return g.Limits.MaxFileSize
+}
+
+// MaxUploadSize limits the whole upload request. Nobody can upload more than
+// the quota at once, the rest is for the multipart overhead.
+func (g *GalleryService) MaxUploadSize() int64 {
+	return g.storageQuota() + 1<<20
+}
+
+func (g *GalleryService) maxImagesPerGallery() int {
+	if g.Limits.MaxImagesPerGallery <= 0 {
+		return DefaultMaxImagesPerGallery
+	}
+	return g.Limits.MaxImagesPerGallery
+}
+
+func (g *GalleryService) storageQuota() int64 {
+	if g.Limits.StorageQuota <= 0 {
+		return DefaultStorageQuota
+	}
+	return g.Limits.StorageQuota
+}
+
+func (g *GalleryService) StorageUsage(ctx context.Context, userID int) (*StorageUsage, error) {
+	usage := StorageUsage{
+		Quota: g.storageQuota(),
+	}
+
+	row := g.DB.QueryRowContext(ctx, `
+    SELECT storage_used
+    FROM users
+    WHERE id = $1;`,
+		userID)
+	err := row.Scan(&usage.Used)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "storage usage", "user ID", userID)
+	}
+	return &usage, nil
+}
+
+func (g *GalleryService) checkFileSize(image *Image) error {
+	if image.Size > g.MaxFileSize() {
+		return errors.Public(
+			errors.Wrap(ErrFileTooLarge, "check file size", "size", image.Size, "max file size", g.MaxFileSize()),
+			fmt.Sprintf("%v is larger than %v.", image.Filename, formatBytes(g.MaxFileSize())),
+		)
+	}
+	return nil
+}
+
+// reserveStorage checks the limits of the gallery and of its owner, and adds
+// the image to the used storage. The row of the owner is locked till the end
+// of the transaction, so the parallel uploads cannot exceed the limits.
+func (g *GalleryService) reserveStorage(ctx context.Context, tx *sql.Tx, image *Image) error {
+	var userID int
+	var used int64
+	row := tx.QueryRowContext(ctx, `
+    SELECT users.id, users.storage_used
+    FROM users
+      JOIN galleries ON galleries.user_id = users.id
+    WHERE galleries.id = $1
+    FOR UPDATE OF users;`,
+		image.GalleryID)
+	err := row.Scan(&userID, &used)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return errors.Wrap(err, "reserve storage", "gallery ID", image.GalleryID)
+	}
+
+	// Note: the image of the same filename is replaced, so it does not count.
+	var count int
+	var replaced int64
+	row = tx.QueryRowContext(ctx, `
+    SELECT COUNT(*) FILTER (WHERE filename <> $2), COALESCE(SUM(size) FILTER (WHERE filename = $2), 0)
+    FROM images
+    WHERE gallery_id = $1;`,
+		image.GalleryID, image.Filename)
+	err = row.Scan(&count, &replaced)
+	if err != nil {
+		return errors.Wrap(err, "reserve storage", "gallery ID", image.GalleryID)
+	}
+
+	if count >= g.maxImagesPerGallery() {
+		return errors.Public(
+			errors.Wrap(ErrGalleryFull, "reserve storage", "gallery ID", image.GalleryID, "max images", g.maxImagesPerGallery()),
+			fmt.Sprintf("A gallery can have at most %d images.", g.maxImagesPerGallery()),
+		)
+	}
+	if used-replaced+image.Size > g.storageQuota() {
+		return errors.Public(
+			errors.Wrap(ErrStorageQuota, "reserve storage", "user ID", userID, "used", used, "size", image.Size),
+			fmt.Sprintf("%v does not fit into your storage quota, %v of %v is used.",
+				image.Filename, formatBytes(used), formatBytes(g.storageQuota())),
+		)
+	}
+
+	err = addStorageUsed(ctx, tx, userID, image.Size-replaced)
+	if err != nil {
+		return errors.Wrap(err, "reserve storage", "gallery ID", image.GalleryID)
+	}
+	return nil
+}
+
+func addStorageUsed(ctx context.Context, db execer, userID int, delta int64) error {
+	_, err := db.ExecContext(ctx, `
+    UPDATE users
+    SET storage_used = GREATEST(0, storage_used + $2)
+    WHERE id = $1;`,
+		userID, delta)
+	if err != nil {
+		return errors.Wrap(err, "add storage used", "user ID", userID, "delta", delta)
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
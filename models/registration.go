@@ -0,0 +1,48 @@
+package models
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	RegistrationOpen    = "open"
+	RegistrationClosed  = "closed"
+	RegistrationInvite  = "invite"
+	RegistrationDomains = "domains"
+)
+
+// RegistrationPolicy decides who may create an account. The nil policy lets
+// everybody in.
+type RegistrationPolicy struct {
+	Mode string
+	// AllowedDomains are checked only in RegistrationDomains mode.
+	AllowedDomains []string
+}
+
+// Check tells whether the email may be used for a new account. The invitation
+// codes are checked when they are redeemed.
+func (r *RegistrationPolicy) Check(email string) error {
+	if r == nil {
+		return nil
+	}
+
+	switch r.Mode {
+	case RegistrationClosed:
+		return ErrRegistrationClosed
+	case RegistrationDomains:
+		_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+		if !slices.Contains(r.AllowedDomains, domain) {
+			return ErrDomainNotAllowed
+		}
+	}
+	return nil
+}
+
+func (r *RegistrationPolicy) InviteOnly() bool {
+	return r != nil && r.Mode == RegistrationInvite
+}
+
+func (r *RegistrationPolicy) Closed() bool {
+	return r != nil && r.Mode == RegistrationClosed
+}
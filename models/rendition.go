@@ -0,0 +1,340 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/storage"
+)
+
+const (
+	RenditionThumbnail = "thumbnail"
+	RenditionMedium    = "medium"
+	RenditionLarge     = "large"
+
+	renditionJPEGQuality = 85
+
+	// renditionQueueSize is the number of the uploads, whose renditions may
+	// wait to be made. The renditions of the rest are made on their first
+	// request.
+	renditionQueueSize = 100
+
+	// renditionTimeout limits the making of the renditions of an image, which
+	// runs without the deadline of a request.
+	renditionTimeout = time.Minute
+)
+
+// Rendition is a downscaled copy of the images, which fits into a box of
+// MaxSize x MaxSize pixels.
+type Rendition struct {
+	Name    string
+	MaxSize int
+}
+
+// Renditions lists every rendition from the smallest.
+var Renditions = []Rendition{
+	{Name: RenditionThumbnail, MaxSize: 320},
+	{Name: RenditionMedium, MaxSize: 800},
+	{Name: RenditionLarge, MaxSize: 1600},
+}
+
+func rendition(name string) (Rendition, error) {
+	for _, r := range Renditions {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return Rendition{}, errors.Wrap(ErrUnknownRendition, "rendition", "name", name)
+}
+
+// RenditionWidth is the width of the rendition of the image. The image is its
+// own rendition, if it fits into the box already.
+func (i *Image) RenditionWidth(r Rendition) int {
+	width, _ := i.renditionSize(r)
+	return width
+}
+
+// HasRendition tells whether the rendition is smaller than the image.
+func (i *Image) HasRendition(r Rendition) bool {
+	return i.Width > r.MaxSize || i.Height > r.MaxSize
+}
+
+func (i *Image) renditionSize(r Rendition) (int, int) {
+	if !i.HasRendition(r) {
+		return i.Width, i.Height
+	}
+	if i.Width >= i.Height {
+		return r.MaxSize, max(1, (i.Height*r.MaxSize+i.Width/2)/i.Width)
+	}
+	return max(1, (i.Width*r.MaxSize+i.Height/2)/i.Height), r.MaxSize
+}
+
+// OpenImage opens the image, or its rendition if the size is given. A missing
+// rendition is made now, so the images before the renditions and the failed
+// ones are fixed on the first request. The location and the serial numbers
+// are removed from the JPEG originals, unless the gallery keeps them.
+func (g *GalleryService) OpenImage(ctx context.Context, galleryID int, filename, size string) (io.ReadCloser, *storage.Object, error) {
+	img, err := g.Image(ctx, galleryID, filename)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open image", "gallery ID", galleryID, "filename", filename)
+	}
+
+	key := img.StorageKey
+	if size != "" {
+		key, err = g.rendition(ctx, img, size)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "open image", "gallery ID", galleryID, "filename", filename)
+		}
+	}
+
+	// Note: the renditions are encoded without EXIF, but a small image is its own rendition.
+	if key == img.StorageKey && img.ContentType == "image/jpeg" {
+		gallery, err := g.ByID(ctx, galleryID)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "open image", "gallery ID", galleryID, "filename", filename)
+		}
+		if gallery.StripMetadata {
+			r, object, err := g.openStripped(ctx, img)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "open image", "gallery ID", galleryID, "filename", filename)
+			}
+			return r, object, nil
+		}
+	}
+
+	r, object, err := g.open(ctx, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open image", "gallery ID", galleryID, "filename", filename)
+	}
+	return r, object, nil
+}
+
+// openOriginal opens the image as it was uploaded, e.g. for the owner.
+func (g *GalleryService) openOriginal(ctx context.Context, img *Image) (io.ReadCloser, *storage.Object, error) {
+	return g.open(ctx, img.StorageKey)
+}
+
+// openStripped opens a copy of the image without the private tags. It is made
+// in the memory, the originals are not big.
+func (g *GalleryService) openStripped(ctx context.Context, img *Image) (io.ReadCloser, *storage.Object, error) {
+	r, object, err := g.open(ctx, img.StorageKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open stripped image", "key", img.StorageKey)
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	err = stripEXIF(&buf, r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open stripped image", "key", img.StorageKey)
+	}
+
+	stripped := *object
+	stripped.Size = int64(buf.Len())
+	return bytesReadCloser{bytes.NewReader(buf.Bytes())}, &stripped, nil
+}
+
+func (g *GalleryService) open(ctx context.Context, key string) (io.ReadCloser, *storage.Object, error) {
+	r, object, err := g.storage().Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			err = ErrNotFound
+		}
+		return nil, nil, errors.Wrap(err, "open", "key", key)
+	}
+	return r, object, nil
+}
+
+// bytesReadCloser can be seeked, so the stripped images are served with
+// ranges too.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+// rendition returns the key of the rendition, and makes it if it is missing.
+func (g *GalleryService) rendition(ctx context.Context, img *Image, name string) (string, error) {
+	r, err := rendition(name)
+	if err != nil {
+		return "", errors.Wrap(err, "rendition")
+	}
+	if !img.HasRendition(r) {
+		return img.StorageKey, nil
+	}
+
+	key := renditionStorageKey(img, r)
+	_, err = g.storage().Stat(ctx, key)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, storage.ErrNotExist) {
+		return "", errors.Wrap(err, "rendition", "key", key)
+	}
+
+	// Note: the concurrent requests of the same missing rendition share one decode, which is not bound to the
+	// request of the first one, so its cancel does not fail the others.
+	_, err, _ = g.renditionFlight.Do(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), renditionTimeout)
+		defer cancel()
+
+		src, err := g.decodeImage(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		return nil, g.writeRendition(ctx, img, src, r)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "rendition", "key", key)
+	}
+	return key, nil
+}
+
+// queueRenditions asks RunRenditions to make the renditions of the uploaded
+// image, so the upload does not wait for the decoding and the resizing, which
+// take seconds for a photo. If the queue is full, they are made on their first
+// request.
+func (g *GalleryService) queueRenditions(img *Image) {
+	select {
+	case g.renditions() <- *img:
+	default:
+		log.Printf("INFO: queue renditions: the queue is full, %v is left for its first request\n", img.StorageKey)
+	}
+}
+
+func (g *GalleryService) renditions() chan Image {
+	g.renditionsOnce.Do(func() {
+		g.renditionQueue = make(chan Image, renditionQueueSize)
+	})
+	return g.renditionQueue
+}
+
+// RunRenditions makes the renditions of the uploaded images one by one until
+// the context is done. One at a time, so a burst of uploads does not take all
+// the memory, and a replaced image is not overwritten by the renditions of its
+// previous content.
+func (g *GalleryService) RunRenditions(ctx context.Context) {
+	queue := g.renditions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case img := <-queue:
+			jobCtx, cancel := context.WithTimeout(ctx, renditionTimeout)
+			err := g.createRenditions(jobCtx, &img)
+			cancel()
+			if err != nil {
+				// Note: the image is there, the missing renditions are made on their first request.
+				log.Printf("ERROR: run renditions: %v\n", err.Error())
+			}
+		}
+	}
+}
+
+// createRenditions makes every rendition of the stored image, and removes the
+// ones, which are not needed, e.g. of a replaced bigger image.
+func (g *GalleryService) createRenditions(ctx context.Context, img *Image) error {
+	src, err := g.decodeImage(ctx, img)
+	if err != nil {
+		return errors.Wrap(err, "create renditions", "gallery ID", img.GalleryID, "filename", img.Filename)
+	}
+
+	for _, r := range Renditions {
+		if !img.HasRendition(r) {
+			err = g.storage().Delete(ctx, renditionStorageKey(img, r))
+		} else {
+			err = g.writeRendition(ctx, img, src, r)
+		}
+		if err != nil {
+			return errors.Wrap(err, "create renditions", "gallery ID", img.GalleryID, "filename", img.Filename)
+		}
+	}
+	return nil
+}
+
+func (g *GalleryService) deleteRenditions(ctx context.Context, img *Image) error {
+	for _, r := range Renditions {
+		err := g.storage().Delete(ctx, renditionStorageKey(img, r))
+		if err != nil {
+			return errors.Wrap(err, "delete renditions", "gallery ID", img.GalleryID, "filename", img.Filename)
+		}
+	}
+	return nil
+}
+
+func (g *GalleryService) decodeImage(ctx context.Context, img *Image) (image.Image, error) {
+	// Note: the images stored before the limit are not decoded either.
+	if int64(img.Width)*int64(img.Height) > MaxImagePixels {
+		return nil, errors.Wrap(FileError{Issue: IssueTooManyPixels}, "decode image", "key", img.StorageKey)
+	}
+
+	r, _, err := g.storage().Get(ctx, img.StorageKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode image", "key", img.StorageKey)
+	}
+	defer r.Close()
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode image", "key", img.StorageKey)
+	}
+	return src, nil
+}
+
+// writeRendition keeps the format of the image, so the rendition is served
+// with the same content type. The rendition is turned upright, because the
+// EXIF is lost by the encoding.
+func (g *GalleryService) writeRendition(ctx context.Context, img *Image, src image.Image, r Rendition) error {
+	key := renditionStorageKey(img, r)
+	width, height := img.renditionSize(r)
+
+	// Note: the width and the height are upright, the source is not turned yet.
+	if img.EXIF.swapsAxes() {
+		width, height = height, width
+	}
+
+	var buf bytes.Buffer
+	err := encodeImage(&buf, img.ContentType, orient(resize(src, width, height), img.EXIF.Orientation))
+	if err != nil {
+		return errors.Wrap(err, "write rendition", "key", key)
+	}
+
+	err = g.storage().Put(ctx, key, &buf, int64(buf.Len()), img.ContentType)
+	if err != nil {
+		return errors.Wrap(err, "write rendition", "key", key)
+	}
+	return nil
+}
+
+func encodeImage(w io.Writer, contentType string, m image.Image) error {
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(w, m, &jpeg.Options{Quality: renditionJPEGQuality})
+	case "image/png":
+		err = png.Encode(w, m)
+	case "image/gif":
+		err = gif.Encode(w, m, nil)
+	default:
+		err = errors.New("unsupported content type")
+	}
+	if err != nil {
+		return errors.Wrap(err, "encode image", "content type", contentType)
+	}
+	return nil
+}
+
+func renditionStorageKey(img *Image, r Rendition) string {
+	return path.Join(path.Dir(img.StorageKey), "renditions", r.Name, path.Base(img.StorageKey))
+}
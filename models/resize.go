@@ -0,0 +1,106 @@
+package models
+
+import (
+	"image"
+	"image/draw"
+)
+
+type resizeWeight struct {
+	index  int
+	weight float64
+}
+
+// resize scales the image down by averaging the covered source pixels. It is
+// only meant for shrinking, the renditions are never bigger than the
+// original.
+func resize(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	xWeights := resizeWeights(bounds.Dx(), width)
+	yWeights := resizeWeights(bounds.Dy(), height)
+
+	// Note: the source is converted row by row, so a big photo is not copied at once.
+	row := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), 1))
+	sum := make([]float64, width*4)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, ys := range yWeights {
+		clear(sum)
+		for _, wy := range ys {
+			draw.Draw(row, row.Bounds(), src, image.Pt(bounds.Min.X, bounds.Min.Y+wy.index), draw.Src)
+			for x, xs := range xWeights {
+				for _, wx := range xs {
+					weight := wx.weight * wy.weight
+					pixel := row.Pix[wx.index*4 : wx.index*4+4]
+					sum[x*4] += float64(pixel[0]) * weight
+					sum[x*4+1] += float64(pixel[1]) * weight
+					sum[x*4+2] += float64(pixel[2]) * weight
+					sum[x*4+3] += float64(pixel[3]) * weight
+				}
+			}
+		}
+
+		pix := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+		for i, v := range sum {
+			pix[i] = uint8(min(v+0.5, 255))
+		}
+	}
+	return dst
+}
+
+// resizeWeights tells which source pixels cover a destination pixel and by
+// how much.
+func resizeWeights(srcLen, dstLen int) [][]resizeWeight {
+	scale := float64(srcLen) / float64(dstLen)
+	weights := make([][]resizeWeight, dstLen)
+	for i := range weights {
+		start := float64(i) * scale
+		end := start + scale
+		for j := int(start); j < srcLen && float64(j) < end; j++ {
+			coverage := min(end, float64(j+1)) - max(start, float64(j))
+			if coverage > 0 {
+				weights[i] = append(weights[i], resizeWeight{
+					index:  j,
+					weight: coverage / scale,
+				})
+			}
+		}
+	}
+	return weights
+}
+
+// orient turns the image upright by the EXIF orientation. It is done on the
+// renditions after the resize, so the big originals are not copied.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := sw, sh
+	if orientation >= 5 {
+		dw, dh = sh, sw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = sw-1-x, y
+			case 3:
+				sx, sy = sw-1-x, sh-1-y
+			case 4:
+				sx, sy = x, sh-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, sh-1-x
+			case 7:
+				sx, sy = sw-1-y, sh-1-x
+			case 8:
+				sx, sy = sw-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -1,69 +1,235 @@
 package models
 
 import (
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"time"
 
 	"github.com/szykes/simple-backend/errors"
 	"github.com/szykes/simple-backend/rand"
 )
 
-const MinBytesPerToken = 32
+const (
+	MinBytesPerToken = 32
+
+	DefaultSessionLifetime     = 24 * time.Hour
+	DefaultSessionIdleTimeout  = 2 * time.Hour
+	DefaultRememberLifetime    = 30 * 24 * time.Hour
+	DefaultRememberIdleTimeout = 7 * 24 * time.Hour
+
+	// ImpersonationLifetime is the longest lifetime of the sessions started by
+	// an admin on behalf of another user.
+	ImpersonationLifetime = 1 * time.Hour
+
+	// ReauthenticationWindow is how long the users without password can do
+	// the sensitive changes after they confirmed it is them by a connected
+	// account.
+	ReauthenticationWindow = 10 * time.Minute
+
+	lastSeenResolution           = 1 * time.Minute
+	sessionsCountForOptimization = 5
+)
 
 type Session struct {
-	ID        int
-	UserID    int
-	Token     string // set only when creating a new session
-	TokenHash string
+	ID         int
+	UserID     int
+	Token      string // set only when creating a new session
+	TokenHash  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	UserAgent  string
+	IPAddress  string
+	ExpiresAt  time.Time
+	Remember   bool
+
+	// ReauthenticatedAt is when the user confirmed it is them by a connected
+	// account.
+	ReauthenticatedAt *time.Time
+
+	ImpersonatorID *int
+	Impersonator   *User // set only when querying the user of the session
+}
+
+// Impersonated tells whether an admin started the session on behalf of the
+// user.
+func (s *Session) Impersonated() bool {
+	return s.ImpersonatorID != nil
+}
+
+// Reauthenticated tells whether the user signed in or confirmed it is them
+// within the ReauthenticationWindow.
+func (s *Session) Reauthenticated() bool {
+	since := time.Now().Add(-ReauthenticationWindow)
+	return s.CreatedAt.After(since) || (s.ReauthenticatedAt != nil && s.ReauthenticatedAt.After(since))
+}
+
+type NewSession struct {
+	UserID         int
+	UserAgent      string
+	IPAddress      string
+	Remember       bool
+	ImpersonatorID *int
 }
 
 type SessionService struct {
 	DB            *sql.DB
 	BytesPerToken int
+
+	Lifetime            time.Duration
+	IdleTimeout         time.Duration
+	RememberLifetime    time.Duration
+	RememberIdleTimeout time.Duration
 }
 
-func (s *SessionService) Create(ctx context.Context, userID int) (*Session, error) {
+func (s *SessionService) Create(ctx context.Context, newSession NewSession) (*Session, error) {
 	bytesPerToken := max(s.BytesPerToken, MinBytesPerToken)
 	token, err := rand.String(bytesPerToken)
 	if err != nil {
-		return nil, errors.Wrap(err, "create session", "user ID", userID)
+		return nil, errors.Wrap(err, "create session", "user ID", newSession.UserID)
+	}
+	lifetime, _ := s.lifetimes(newSession.Remember)
+	if newSession.ImpersonatorID != nil {
+		lifetime = min(lifetime, ImpersonationLifetime)
 	}
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: s.hash(token),
+		UserID:         newSession.UserID,
+		Token:          token,
+		TokenHash:      s.hash(token),
+		UserAgent:      newSession.UserAgent,
+		IPAddress:      newSession.IPAddress,
+		ExpiresAt:      time.Now().Add(lifetime),
+		Remember:       newSession.Remember,
+		ImpersonatorID: newSession.ImpersonatorID,
 	}
 
 	row := s.DB.QueryRowContext(ctx, `
-    INSERT INTO sessions (user_id, token_hash)
-    VALUES ($1, $2) ON CONFLICT (user_id)
-    DO UPDATE SET token_hash = $2
-    RETURNING id;`,
-		session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+    INSERT INTO sessions (user_id, token_hash, user_agent, ip_address, expires_at, remember, impersonator_id)
+    SELECT $1, $2, $3, $4, $5, $6, $7
+    WHERE EXISTS (SELECT 1 FROM users WHERE id = $1 AND disabled_at IS NULL)
+    RETURNING id, created_at, last_seen_at;`,
+		session.UserID, session.TokenHash, session.UserAgent, session.IPAddress, session.ExpiresAt, session.Remember,
+		session.ImpersonatorID)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 	if err != nil {
-		return nil, errors.Wrap(err, "create session", "user ID", userID)
+		// Note: every sign in ends here, so the disabled users are checked only once.
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrAccountDisabled
+		}
+		return nil, errors.Wrap(err, "create session", "user ID", newSession.UserID)
 	}
 	return &session, nil
 }
 
-func (s *SessionService) User(ctx context.Context, token string) (*User, error) {
+func (s *SessionService) User(ctx context.Context, token string) (*User, *Session, error) {
 	tokenHash := s.hash(token)
 
 	var user User
+	session := Session{
+		TokenHash: tokenHash,
+	}
 	row := s.DB.QueryRowContext(ctx, `
-    SELECT users.id, users.name, users.email, users.password_hash
+    SELECT sessions.id, sessions.created_at, sessions.last_seen_at, sessions.user_agent, sessions.ip_address,
+      sessions.expires_at, sessions.remember, sessions.reauthenticated_at,
+      users.id, users.name, users.email, users.password_hash, users.email_verified_at, users.totp_enabled_at,
+      users.role,
+      sessions.impersonator_id, impersonators.name, impersonators.email, impersonators.role
     FROM sessions
     JOIN users ON users.id = sessions.user_id
-    WHERE sessions.token_hash = $1;`,
+    LEFT JOIN users AS impersonators ON impersonators.id = sessions.impersonator_id
+    WHERE sessions.token_hash = $1 AND users.disabled_at IS NULL;`,
 		tokenHash)
-	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash)
+	var impersonatorName, impersonatorEmail, impersonatorRole sql.NullString
+	err := row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt, &session.UserAgent, &session.IPAddress,
+		&session.ExpiresAt, &session.Remember, &session.ReauthenticatedAt,
+		&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.TOTPEnabledAt,
+		&user.Role,
+		&session.ImpersonatorID, &impersonatorName, &impersonatorEmail, &impersonatorRole)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, nil, errors.Wrap(err, "session user")
+	}
+	session.UserID = user.ID
+	if session.ImpersonatorID != nil {
+		session.Impersonator = &User{
+			ID:    *session.ImpersonatorID,
+			Name:  impersonatorName.String,
+			Email: impersonatorEmail.String,
+			Role:  impersonatorRole.String,
+		}
+	}
+
+	_, idleTimeout := s.lifetimes(session.Remember)
+	now := time.Now()
+	if now.After(session.ExpiresAt) || now.After(session.LastSeenAt.Add(idleTimeout)) {
+		_, err = s.DB.ExecContext(ctx, `
+      DELETE FROM sessions
+      WHERE id = $1;`,
+			session.ID)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "session user", "session ID", session.ID)
+		}
+		return nil, nil, errors.Wrap(ErrTokenExpired, "session user", "session ID", session.ID)
+	}
+
+	if time.Since(session.LastSeenAt) > lastSeenResolution {
+		row = s.DB.QueryRowContext(ctx, `
+      UPDATE sessions
+      SET last_seen_at = NOW()
+      WHERE id = $1
+      RETURNING last_seen_at;`,
+			session.ID)
+		err = row.Scan(&session.LastSeenAt)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "session user", "session ID", session.ID)
+		}
+	}
+
+	return &user, &session, nil
+}
+
+// CookieExpiresAt tells until when the cookie of the session should live if
+// there is no further activity.
+func (s *SessionService) CookieExpiresAt(session *Session) time.Time {
+	_, idleTimeout := s.lifetimes(session.Remember)
+	idleExpiresAt := session.LastSeenAt.Add(idleTimeout)
+	if idleExpiresAt.Before(session.ExpiresAt) {
+		return idleExpiresAt
+	}
+	return session.ExpiresAt
+}
+
+func (s *SessionService) ByUserID(ctx context.Context, userID int) ([]Session, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+    SELECT id, created_at, last_seen_at, user_agent, ip_address
+    FROM sessions
+    WHERE user_id = $1 AND expires_at > NOW() AND impersonator_id IS NULL
+    ORDER BY last_seen_at DESC;`,
+		userID)
 	if err != nil {
-		return nil, errors.Wrap(err, "create user session")
+		return nil, errors.Wrap(err, "sessions by user ID", "user ID", userID)
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0, sessionsCountForOptimization)
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err = rows.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt, &session.UserAgent, &session.IPAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "sessions by user ID", "user ID", userID)
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sessions by user ID", "user ID", userID)
 	}
-	return &user, nil
+	return sessions, nil
 }
 
 func (s *SessionService) Delete(ctx context.Context, token string) error {
@@ -79,6 +245,83 @@ func (s *SessionService) Delete(ctx context.Context, token string) error {
 	return nil
 }
 
+func (s *SessionService) DeleteByID(ctx context.Context, userID, id int) error {
+	result, err := s.DB.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE id = $1 AND user_id = $2;`,
+		id, userID)
+	if err != nil {
+		return errors.Wrap(err, "delete session by ID", "user ID", userID, "ID", id)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "delete session by ID", "user ID", userID, "ID", id)
+	}
+	if affected == 0 {
+		return errors.Wrap(ErrNotFound, "delete session by ID", "user ID", userID, "ID", id)
+	}
+	return nil
+}
+
+func (s *SessionService) Reauthenticate(ctx context.Context, id int) error {
+	_, err := s.DB.ExecContext(ctx, `
+    UPDATE sessions
+    SET reauthenticated_at = NOW()
+    WHERE id = $1;`,
+		id)
+	if err != nil {
+		return errors.Wrap(err, "reauthenticate session", "ID", id)
+	}
+	return nil
+}
+
+func (s *SessionService) DeleteOthers(ctx context.Context, userID, keepID int) error {
+	_, err := s.DB.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE user_id = $1 AND id <> $2;`,
+		userID, keepID)
+	if err != nil {
+		return errors.Wrap(err, "delete other sessions", "user ID", userID, "kept ID", keepID)
+	}
+	return nil
+}
+
+func (s *SessionService) DeleteAll(ctx context.Context, userID int) error {
+	_, err := s.DB.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE user_id = $1;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "delete all sessions", "user ID", userID)
+	}
+	return nil
+}
+
+func (s *SessionService) DeleteExpired(ctx context.Context) error {
+	_, idleTimeout := s.lifetimes(false)
+	_, rememberIdleTimeout := s.lifetimes(true)
+	now := time.Now()
+
+	_, err := s.DB.ExecContext(ctx, `
+    DELETE FROM sessions
+    WHERE expires_at < $1
+      OR (NOT remember AND last_seen_at < $2)
+      OR (remember AND last_seen_at < $3);`,
+		now, now.Add(-idleTimeout), now.Add(-rememberIdleTimeout))
+	if err != nil {
+		return errors.Wrap(err, "delete expired sessions")
+	}
+	return nil
+}
+
+func (s *SessionService) lifetimes(remember bool) (time.Duration, time.Duration) {
+	if remember {
+		return cmp.Or(s.RememberLifetime, DefaultRememberLifetime), cmp.Or(s.RememberIdleTimeout, DefaultRememberIdleTimeout)
+	}
+	return cmp.Or(s.Lifetime, DefaultSessionLifetime), cmp.Or(s.IdleTimeout, DefaultSessionIdleTimeout)
+}
+
 func (s *SessionService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
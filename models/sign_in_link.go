@@ -0,0 +1,137 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+const (
+	DefaultSignInLinkDuration = 15 * time.Minute
+)
+
+type SignInLink struct {
+	ID        int
+	UserID    int
+	Token     string // set only when creating a new sign in link
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// SignInLinkService handles the single-use tokens of the passwordless sign
+// in, which are sent by email.
+type SignInLinkService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (s *SignInLinkService) Create(ctx context.Context, email string) (*SignInLink, error) {
+	email = strings.ToLower(email)
+
+	var userID int
+	row := s.DB.QueryRowContext(ctx, `
+    SELECT id
+    FROM users
+    WHERE email = $1 AND deleted_at IS NULL;`,
+		email)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "sign in link create")
+	}
+
+	bytesPerToken := max(s.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign in link create", "user ID", userID)
+	}
+
+	duration := s.Duration
+	if duration == 0 {
+		duration = DefaultSignInLinkDuration
+	}
+	link := SignInLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: s.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = s.DB.QueryRowContext(ctx, `
+    INSERT INTO sign_in_links (user_id, token_hash, expires_at)
+    VALUES ($1, $2, $3) ON CONFLICT (user_id)
+    DO UPDATE SET token_hash = $2, expires_at = $3
+    RETURNING id;`,
+		link.UserID, link.TokenHash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign in link create", "user ID", userID)
+	}
+
+	return &link, nil
+}
+
+// Consume deletes the token and returns its user. The email counts as
+// verified, because the token was sent to it.
+func (s *SignInLinkService) Consume(ctx context.Context, token string) (*User, error) {
+	tokenHash := s.hash(token)
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign in link consume")
+	}
+	defer tx.Rollback()
+
+	var link SignInLink
+	row := tx.QueryRowContext(ctx, `
+    DELETE FROM sign_in_links
+    WHERE token_hash = $1
+    RETURNING id, user_id, expires_at;`,
+		tokenHash)
+	err = row.Scan(&link.ID, &link.UserID, &link.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "sign in link consume")
+	}
+
+	if time.Now().After(link.ExpiresAt) {
+		return nil, errors.Wrap(ErrTokenExpired, "sign in link consume", "user ID", link.UserID)
+	}
+
+	var user User
+	row = tx.QueryRowContext(ctx, `
+    UPDATE users
+    SET email_verified_at = COALESCE(email_verified_at, NOW())
+    WHERE id = $1 AND deleted_at IS NULL
+    RETURNING id, name, email, password_hash, email_verified_at, totp_enabled_at;`,
+		link.UserID)
+	err = row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.TOTPEnabledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "sign in link consume", "user ID", link.UserID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "sign in link consume", "user ID", link.UserID)
+	}
+	return &user, nil
+}
+
+func (s *SignInLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,399 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+	"github.com/szykes/simple-backend/totp"
+)
+
+const (
+	DefaultChallengeDuration = 5 * time.Minute
+
+	maxChallengeAttempts = 5
+	recoveryCodesCount   = 10
+	recoveryCodeBytes    = 10
+)
+
+type TwoFactorChallenge struct {
+	ID        int
+	UserID    int
+	Token     string // set only when creating a new challenge
+	TokenHash string
+	Remember  bool
+	ExpiresAt time.Time
+}
+
+type TwoFactorService struct {
+	DB                *sql.DB
+	BytesPerToken     int
+	ChallengeDuration time.Duration
+	Issuer            string
+}
+
+// Enroll generates a new secret, which is only used after the user confirmed
+// it by Enable.
+func (t *TwoFactorService) Enroll(ctx context.Context, userID int) (string, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", errors.Wrap(err, "2fa enroll", "user ID", userID)
+	}
+
+	result, err := t.DB.ExecContext(ctx, `
+    UPDATE users
+    SET totp_secret = $2
+    WHERE id = $1 AND totp_enabled_at IS NULL;`,
+		userID, secret)
+	if err != nil {
+		return "", errors.Wrap(err, "2fa enroll", "user ID", userID)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return "", errors.Wrap(err, "2fa enroll", "user ID", userID)
+	}
+	if affected == 0 {
+		return "", errors.Wrap(ErrTwoFactorEnabled, "2fa enroll", "user ID", userID)
+	}
+
+	return secret, nil
+}
+
+func (t *TwoFactorService) Enrollment(ctx context.Context, userID int) (string, error) {
+	var secret sql.NullString
+	row := t.DB.QueryRowContext(ctx, `
+    SELECT totp_secret
+    FROM users
+    WHERE id = $1 AND totp_enabled_at IS NULL;`,
+		userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrTwoFactorEnabled
+		}
+		return "", errors.Wrap(err, "2fa enrollment", "user ID", userID)
+	}
+	if !secret.Valid {
+		return "", errors.Wrap(ErrNotFound, "2fa enrollment", "user ID", userID)
+	}
+	return secret.String, nil
+}
+
+func (t *TwoFactorService) URI(email, secret string) string {
+	return totp.URI(t.Issuer, email, secret)
+}
+
+// Enable turns on the 2FA if the code matches the enrolled secret. It returns
+// the recovery codes, which are not stored in plaintext, so they cannot be
+// shown again.
+func (t *TwoFactorService) Enable(ctx context.Context, userID int, code string) ([]string, error) {
+	secret, err := t.Enrollment(ctx, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+
+	step, err := totp.Validate(secret, code, time.Now())
+	if err != nil {
+		if errors.Is(err, totp.ErrInvalidCode) {
+			err = ErrInvalidCode
+		}
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+
+	tx, err := t.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE users
+    SET totp_enabled_at = NOW(), totp_last_step = $2
+    WHERE id = $1;`,
+		userID, step)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+
+	codes, err := t.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa enable", "user ID", userID)
+	}
+	return codes, nil
+}
+
+func (t *TwoFactorService) Disable(ctx context.Context, userID int) error {
+	tx, err := t.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "2fa disable", "user ID", userID)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE users
+    SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+    WHERE id = $1;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "2fa disable", "user ID", userID)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    DELETE FROM recovery_codes
+    WHERE user_id = $1;`,
+		userID)
+	if err != nil {
+		return errors.Wrap(err, "2fa disable", "user ID", userID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "2fa disable", "user ID", userID)
+	}
+	return nil
+}
+
+func (t *TwoFactorService) RemainingRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	var count int
+	row := t.DB.QueryRowContext(ctx, `
+    SELECT COUNT(*)
+    FROM recovery_codes
+    WHERE user_id = $1 AND used_at IS NULL;`,
+		userID)
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "2fa remaining recovery codes", "user ID", userID)
+	}
+	return count, nil
+}
+
+// Verify accepts either a TOTP code or an unused recovery code. A TOTP code
+// cannot be used twice.
+func (t *TwoFactorService) Verify(ctx context.Context, userID int, code string) error {
+	var secret sql.NullString
+	row := t.DB.QueryRowContext(ctx, `
+    SELECT totp_secret
+    FROM users
+    WHERE id = $1 AND totp_enabled_at IS NOT NULL;`,
+		userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return errors.Wrap(err, "2fa verify", "user ID", userID)
+	}
+
+	step, err := totp.Validate(secret.String, code, time.Now())
+	if err == nil {
+		result, err := t.DB.ExecContext(ctx, `
+      UPDATE users
+      SET totp_last_step = $2
+      WHERE id = $1 AND totp_last_step < $2;`,
+			userID, step)
+		if err != nil {
+			return errors.Wrap(err, "2fa verify", "user ID", userID)
+		}
+		return t.oneRowAffected(result, "2fa verify", userID)
+	}
+	if !errors.Is(err, totp.ErrInvalidCode) {
+		return errors.Wrap(err, "2fa verify", "user ID", userID)
+	}
+
+	result, err := t.DB.ExecContext(ctx, `
+    UPDATE recovery_codes
+    SET used_at = NOW()
+    WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`,
+		userID, t.hash(normalizeRecoveryCode(code)))
+	if err != nil {
+		return errors.Wrap(err, "2fa verify", "user ID", userID)
+	}
+	return t.oneRowAffected(result, "2fa verify", userID)
+}
+
+func (t *TwoFactorService) CreateChallenge(ctx context.Context, userID int, remember bool) (*TwoFactorChallenge, error) {
+	bytesPerToken := max(t.BytesPerToken, MinBytesPerToken)
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa create challenge", "user ID", userID)
+	}
+
+	duration := t.ChallengeDuration
+	if duration == 0 {
+		duration = DefaultChallengeDuration
+	}
+	challenge := TwoFactorChallenge{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: t.hash(token),
+		Remember:  remember,
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := t.DB.QueryRowContext(ctx, `
+    INSERT INTO two_factor_challenges (user_id, token_hash, remember, expires_at)
+    VALUES ($1, $2, $3, $4)
+    RETURNING id;`,
+		challenge.UserID, challenge.TokenHash, challenge.Remember, challenge.ExpiresAt)
+	err = row.Scan(&challenge.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa create challenge", "user ID", userID)
+	}
+	return &challenge, nil
+}
+
+// Challenge finds the challenge without consuming it, e.g. to know whose
+// attempts are counted.
+func (t *TwoFactorService) Challenge(ctx context.Context, token string) (*TwoFactorChallenge, error) {
+	challenge := TwoFactorChallenge{
+		TokenHash: t.hash(token),
+	}
+	row := t.DB.QueryRowContext(ctx, `
+    SELECT id, user_id, remember, expires_at
+    FROM two_factor_challenges
+    WHERE token_hash = $1;`,
+		challenge.TokenHash)
+	err := row.Scan(&challenge.ID, &challenge.UserID, &challenge.Remember, &challenge.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "2fa challenge")
+	}
+	return &challenge, nil
+}
+
+// CompleteChallenge consumes the challenge if the code is right. The challenge
+// is thrown away after too many wrong codes.
+func (t *TwoFactorService) CompleteChallenge(ctx context.Context, token, code string) (*TwoFactorChallenge, error) {
+	challenge, err := t.Challenge(ctx, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa complete challenge")
+	}
+
+	if time.Now().After(challenge.ExpiresAt) {
+		err = t.deleteChallenge(ctx, challenge.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "2fa complete challenge", "user ID", challenge.UserID)
+		}
+		return nil, errors.Wrap(ErrTokenExpired, "2fa complete challenge", "user ID", challenge.UserID)
+	}
+
+	err = t.Verify(ctx, challenge.UserID, code)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCode) {
+			return nil, errors.Wrap(err, "2fa complete challenge", "user ID", challenge.UserID)
+		}
+
+		var attempts int
+		row := t.DB.QueryRowContext(ctx, `
+      UPDATE two_factor_challenges
+      SET attempts = attempts + 1
+      WHERE id = $1
+      RETURNING attempts;`,
+			challenge.ID)
+		scanErr := row.Scan(&attempts)
+		if scanErr != nil {
+			return nil, errors.Wrap(scanErr, "2fa complete challenge", "user ID", challenge.UserID)
+		}
+		if attempts >= maxChallengeAttempts {
+			deleteErr := t.deleteChallenge(ctx, challenge.ID)
+			if deleteErr != nil {
+				return nil, errors.Wrap(deleteErr, "2fa complete challenge", "user ID", challenge.UserID)
+			}
+			return nil, errors.Wrap(ErrTokenExpired, "2fa complete challenge", "user ID", challenge.UserID)
+		}
+		return nil, errors.Wrap(err, "2fa complete challenge", "user ID", challenge.UserID)
+	}
+
+	err = t.deleteChallenge(ctx, challenge.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "2fa complete challenge", "user ID", challenge.UserID)
+	}
+	return challenge, nil
+}
+
+func (t *TwoFactorService) DeleteExpiredChallenges(ctx context.Context) error {
+	_, err := t.DB.ExecContext(ctx, `
+    DELETE FROM two_factor_challenges
+    WHERE expires_at < NOW();`)
+	if err != nil {
+		return errors.Wrap(err, "2fa delete expired challenges")
+	}
+	return nil
+}
+
+func (t *TwoFactorService) deleteChallenge(ctx context.Context, id int) error {
+	_, err := t.DB.ExecContext(ctx, `
+    DELETE FROM two_factor_challenges
+    WHERE id = $1;`,
+		id)
+	if err != nil {
+		return errors.Wrap(err, "2fa delete challenge", "ID", id)
+	}
+	return nil
+}
+
+func (t *TwoFactorService) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	_, err := tx.ExecContext(ctx, `
+    DELETE FROM recovery_codes
+    WHERE user_id = $1;`,
+		userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "replace recovery codes", "user ID", userID)
+	}
+
+	codes := make([]string, 0, recoveryCodesCount)
+	for range recoveryCodesCount {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "replace recovery codes", "user ID", userID)
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := encoded[:8] + "-" + encoded[8:16]
+
+		_, err = tx.ExecContext(ctx, `
+      INSERT INTO recovery_codes (user_id, code_hash)
+      VALUES ($1, $2);`,
+			userID, t.hash(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, errors.Wrap(err, "replace recovery codes", "user ID", userID)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func (t *TwoFactorService) oneRowAffected(result sql.Result, msg string, userID int) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, msg, "user ID", userID)
+	}
+	if affected == 0 {
+		return errors.Wrap(ErrInvalidCode, msg, "user ID", userID)
+	}
+	return nil
+}
+
+func (t *TwoFactorService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
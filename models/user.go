@@ -3,23 +3,66 @@ package models
 import (
 	"context"
 	"database/sql"
+	"log"
+	"net/mail"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/szykes/simple-backend/errors"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/szykes/simple-backend/password"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+
+	usersPerPage = 50
 )
 
 type User struct {
-	ID           int
-	Name         string
-	Email        string
-	PasswordHash string
+	ID              int
+	Name            string
+	Email           string
+	PasswordHash    string
+	EmailVerifiedAt *time.Time
+	TOTPEnabledAt   *time.Time
+	DeletedAt       *time.Time
+	Role            string
+	DisabledAt      *time.Time
+}
+
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+func (u *User) HasRole(role string) bool {
+	return u.Role == role
+}
+
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// Deleted tells whether the user asked for the deletion of the account.
+func (u *User) Deleted() bool {
+	return u.DeletedAt != nil
 }
 
 type UserService struct {
-	DB *sql.DB
+	DB           *sql.DB
+	Hasher       password.Hasher
+	Policy       *password.Policy
+	Registration *RegistrationPolicy
+
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
 type NewUser struct {
@@ -27,24 +70,49 @@ type NewUser struct {
 	Email           string
 	Password        string
 	ConfirmPassword string
+	InvitationCode  string
 }
 
 func (u *UserService) Create(ctx context.Context, newUser NewUser) (*User, error) {
 	var user User
 	user.Name = newUser.Name
-	user.Email = strings.ToLower(newUser.Email)
+	user.Email = strings.ToLower(strings.TrimSpace(newUser.Email))
+
+	err := checkEmail(user.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "create user")
+	}
+
+	err = u.Registration.Check(user.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "create user")
+	}
+	if u.Registration.InviteOnly() && newUser.InvitationCode == "" {
+		return nil, errors.Wrap(ErrInvalidInvitation, "create user")
+	}
 
 	if newUser.Password != newUser.ConfirmPassword {
 		return nil, errors.Wrap(ErrPwMismatch, "create user")
 	}
 
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	err = u.ValidatePassword(newUser.Password, user.Email)
 	if err != nil {
 		return nil, errors.Wrap(err, "create user")
 	}
-	user.PasswordHash = string(hashedBytes)
 
-	row := u.DB.QueryRowContext(ctx, `
+	passwordHash, err := u.hasher().Hash(newUser.Password)
+	if err != nil {
+		return nil, errors.Wrap(err, "create user")
+	}
+	user.PasswordHash = passwordHash
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create user")
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
     INSERT INTO users (name, email, password_hash)
     VALUES ($1, $2, $3)
     RETURNING id;`,
@@ -60,40 +128,179 @@ func (u *UserService) Create(ctx context.Context, newUser NewUser) (*User, error
 		return nil, errors.Wrap(err, "create user")
 	}
 
+	if u.Registration.InviteOnly() {
+		err = redeemInvitation(ctx, tx, newUser.InvitationCode, user.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "create user")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "create user")
+	}
 	return &user, nil
 }
 
-func (u *UserService) Authenticate(ctx context.Context, email, password string) (*User, error) {
+func (u *UserService) Authenticate(ctx context.Context, email, pw string) (*User, error) {
 	email = strings.ToLower(email)
 	user := User{
 		Email: email,
 	}
 	row := u.DB.QueryRowContext(ctx, `
-    SELECT id, password_hash
+    SELECT id, name, password_hash, email_verified_at, totp_enabled_at, deleted_at
     FROM users
     WHERE email=$1;`,
 		email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Name, &user.PasswordHash, &user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.DeletedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			// Note: comparing anyway, so the response time does not tell whether the email exists.
+			_ = password.Compare(u.dummyPasswordHash(), pw)
 			err = ErrNotFound
 		}
 		return nil, errors.Wrap(err, "authenticate user")
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	err = password.Compare(user.PasswordHash, pw)
 	if err != nil {
+		if errors.Is(err, password.ErrMismatch) {
+			err = ErrWrongPw
+		}
 		return nil, errors.Wrap(err, "authenticate user")
 	}
+
+	if u.hasher().NeedsRehash(user.PasswordHash) {
+		err = u.rehash(ctx, &user, pw)
+		if err != nil {
+			// Note: the old hash is still valid, so the sign in should not fail because of it.
+			log.Printf("ERROR: authenticate user: %v\n", err.Error())
+		}
+	}
 	return &user, nil
 }
 
-func (u *UserService) UpdatePassword(ctx context.Context, userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func (u *UserService) ByID(ctx context.Context, id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+	row := u.DB.QueryRowContext(ctx, `
+    SELECT name, email, email_verified_at, totp_enabled_at, deleted_at, role, disabled_at
+    FROM users
+    WHERE id = $1;`,
+		id)
+	err := row.Scan(&user.Name, &user.Email, &user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.DeletedAt,
+		&user.Role, &user.DisabledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return nil, errors.Wrap(err, "user by ID", "ID", id)
+	}
+	return &user, nil
+}
+
+// Search lists the users, whose name or email contains the query, ordered by
+// ID. The page starts from 0.
+func (u *UserService) Search(ctx context.Context, query string, page int) ([]User, error) {
+	pattern := "%" + escapeLike(strings.ToLower(query)) + "%"
+	rows, err := u.DB.QueryContext(ctx, `
+    SELECT id, name, email, email_verified_at, totp_enabled_at, deleted_at, role, disabled_at
+    FROM users
+    WHERE LOWER(name) LIKE $1 OR email LIKE $1
+    ORDER BY id
+    LIMIT $2 OFFSET $3;`,
+		pattern, usersPerPage, max(page, 0)*usersPerPage)
+	if err != nil {
+		return nil, errors.Wrap(err, "search users", "query", query)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, usersPerPage)
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerifiedAt, &user.TOTPEnabledAt, &user.DeletedAt,
+			&user.Role, &user.DisabledAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "search users", "query", query)
+		}
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		return nil, errors.Wrap(rows.Err(), "search users", "query", query)
+	}
+	return users, nil
+}
+
+// SetDisabled disables or enables the user. The disabled users cannot sign
+// in, and their sessions are not accepted.
+func (u *UserService) SetDisabled(ctx context.Context, id int, disabled bool) error {
+	result, err := u.DB.ExecContext(ctx, `
+    UPDATE users
+    SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, NOW()) END
+    WHERE id = $1;`,
+		id, disabled)
+	if err != nil {
+		return errors.Wrap(err, "set user disabled", "ID", id)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "set user disabled", "ID", id)
+	}
+	if n == 0 {
+		return errors.Wrap(ErrNotFound, "set user disabled", "ID", id)
+	}
+	return nil
+}
+
+func (u *UserService) UpdateName(ctx context.Context, userID int, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.Wrap(ErrNameEmpty, "update name", "user ID", userID)
+	}
+
+	result, err := u.DB.ExecContext(ctx, `
+    UPDATE users
+    SET name = $2
+    WHERE id = $1;`, userID, name)
+	if err != nil {
+		return errors.Wrap(err, "update name", "user ID", userID)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "update name", "user ID", userID)
+	}
+	if n == 0 {
+		return errors.Wrap(ErrNotFound, "update name", "user ID", userID)
+	}
+	return nil
+}
+
+func (u *UserService) UpdatePassword(ctx context.Context, userID int, pw string) error {
+	var email string
+	row := u.DB.QueryRowContext(ctx, `
+    SELECT email
+    FROM users
+    WHERE id = $1;`, userID)
+	err := row.Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return errors.Wrap(err, "update password")
+	}
+
+	err = u.ValidatePassword(pw, email)
+	if err != nil {
+		return errors.Wrap(err, "update password")
+	}
+
+	passwordHash, err := u.hasher().Hash(pw)
 	if err != nil {
 		return errors.Wrap(err, "update password")
 	}
-	passwordHash := string(hashedBytes)
 
 	_, err = u.DB.ExecContext(ctx, `
     UPDATE users
@@ -105,3 +312,64 @@ func (u *UserService) UpdatePassword(ctx context.Context, userID int, password s
 
 	return nil
 }
+
+// ValidatePassword checks the password against the policy. Its errors can
+// be shown to the user as they are.
+func (u *UserService) ValidatePassword(pw, email string) error {
+	if u.Policy == nil {
+		return nil
+	}
+	return u.Policy.Validate(pw, email)
+}
+
+func (u *UserService) rehash(ctx context.Context, user *User, pw string) error {
+	passwordHash, err := u.hasher().Hash(pw)
+	if err != nil {
+		return errors.Wrap(err, "rehash password", "user ID", user.ID)
+	}
+
+	// Note: the old hash is in the condition, so a concurrent password change is not overwritten.
+	_, err = u.DB.ExecContext(ctx, `
+    UPDATE users
+    SET password_hash = $3
+    WHERE id = $1 AND password_hash = $2;`,
+		user.ID, user.PasswordHash, passwordHash)
+	if err != nil {
+		return errors.Wrap(err, "rehash password", "user ID", user.ID)
+	}
+
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (u *UserService) hasher() password.Hasher {
+	if u.Hasher == nil {
+		return &password.Bcrypt{}
+	}
+	return u.Hasher
+}
+
+func (u *UserService) dummyPasswordHash() string {
+	u.dummyHashOnce.Do(func() {
+		var err error
+		u.dummyHash, err = u.hasher().Hash("dummy password")
+		if err != nil {
+			panic(err)
+		}
+	})
+	return u.dummyHash
+}
+
+// checkEmail accepts only a bare address, e.g. "name@example.com", so a name
+// or a list cannot be smuggled into the emails.
+func checkEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return errors.Wrap(ErrEmailInvalid, "check email", "email", email)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	// minKeyRefresh limits how often the keys are fetched again because of an
+	// unknown key ID, so forged tokens cannot flood the provider.
+	minKeyRefresh = time.Minute
+)
+
+type keySet struct {
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verifySignature checks the signature of the compact JWS and returns its
+// payload. Only RS256 and ES256 are accepted.
+func verifySignature(token string, key func(kid string) (any, error)) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: malformed")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: header", "error", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: header", "error", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: signature", "error", err)
+	}
+
+	pub, err := key(header.Kid)
+	if err != nil {
+		return nil, errors.Wrap(err, "verify signature")
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.Wrap(ErrInvalidToken, "verify signature: key type mismatch", "alg", header.Alg)
+		}
+		err = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidToken, "verify signature", "error", err)
+		}
+	case "ES256":
+		ecKey, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.Wrap(ErrInvalidToken, "verify signature: key type mismatch", "alg", header.Alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, errors.Wrap(ErrInvalidToken, "verify signature: bad signature")
+		}
+	default:
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: unsupported algorithm", "alg", header.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "verify signature: payload", "error", err)
+	}
+	return payload, nil
+}
+
+// key returns the signing key of the provider. The keys are fetched again if
+// the key ID is unknown, because the providers rotate their keys.
+func (p *Provider) key(ctx context.Context, cfg *config, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil {
+		if key, ok := p.keys.keys[kid]; ok {
+			return key, nil
+		}
+		if time.Since(p.keys.fetchedAt) < minKeyRefresh {
+			return nil, errors.Wrap(ErrInvalidToken, "oidc key: unknown key ID", "kid", kid)
+		}
+	}
+
+	keys, err := p.fetchKeys(ctx, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc key")
+	}
+	p.keys = keys
+
+	key, ok := keys.keys[kid]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidToken, "oidc key: unknown key ID", "kid", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, cfg *config) (*keySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.JWKSURI, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch keys", "url", cfg.JWKSURI)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = p.do(req, &set)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch keys", "url", cfg.JWKSURI)
+	}
+
+	keys := keySet{
+		keys:      make(map[string]any, len(set.Keys)),
+		fetchedAt: time.Now(),
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Note: a provider may publish keys of other types, they are just skipped.
+			continue
+		}
+		keys.keys[k.Kid] = key
+	}
+	return &keys, nil
+}
+
+func (k *jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "rsa public key")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "rsa public key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve", "crv", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "ec public key")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "ec public key")
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, errors.New("unsupported key type", "kty", k.Kty)
+	}
+}
@@ -0,0 +1,278 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid ID token")
+)
+
+const (
+	// leeway is the allowed clock skew between the app and the provider.
+	leeway = time.Minute
+
+	bytesPerSecret = 32
+)
+
+// Provider is an OpenID Connect provider, which is used by the authorization
+// code flow with PKCE. Its endpoints are discovered from the issuer.
+type Provider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+
+	mu     sync.Mutex
+	config *config
+	keys   *keySet
+}
+
+type config struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Flow is the state of a started sign in, which must be kept until the
+// callback, e.g. in a cookie.
+type Flow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewFlow creates the random secrets of a new sign in.
+func NewFlow() (*Flow, error) {
+	var flow Flow
+	for _, secret := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		b, err := rand.Bytes(bytesPerSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "new oidc flow")
+		}
+		*secret = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return &flow, nil
+}
+
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// AuthCodeURL is the URL of the provider, where the user is redirected to
+// sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, flow *Flow) (string, error) {
+	cfg, err := p.discover(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "oidc auth code url", "provider", p.Name)
+	}
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.scopes(), " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(cfg.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return cfg.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the claims of the
+// verified ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, flow *Flow) (*Claims, error) {
+	cfg, err := p.discover(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc exchange", "provider", p.Name)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc exchange", "provider", p.Name)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = p.do(req, &token)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc exchange", "provider", p.Name)
+	}
+	if token.IDToken == "" {
+		return nil, errors.Wrap(ErrInvalidToken, "oidc exchange: no ID token", "provider", p.Name)
+	}
+
+	claims, err := p.verify(ctx, cfg, token.IDToken, flow.Nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc exchange", "provider", p.Name)
+	}
+	return claims, nil
+}
+
+func (p *Provider) verify(ctx context.Context, cfg *config, idToken, nonce string) (*Claims, error) {
+	payload, err := verifySignature(idToken, func(kid string) (any, error) {
+		return p.key(ctx, cfg, kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "verify ID token")
+	}
+
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token", "error", err)
+	}
+
+	switch {
+	case claims.Issuer != cfg.Issuer:
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token: wrong issuer", "issuer", claims.Issuer)
+	case !slices.Contains(claims.Audience, p.ClientID):
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token: wrong audience")
+	case time.Now().Add(-leeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token: expired")
+	case claims.Nonce != nonce:
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token: wrong nonce")
+	case claims.Subject == "":
+		return nil, errors.Wrap(ErrInvalidToken, "verify ID token: no subject")
+	}
+	return &claims, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc discover", "issuer", p.Issuer)
+	}
+
+	var cfg config
+	err = p.do(req, &cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc discover", "issuer", p.Issuer)
+	}
+	// Note: the issuer must be the same, otherwise the provider could claim to be another one.
+	if cfg.Issuer != p.Issuer {
+		return nil, errors.New("oidc discover: issuer mismatch", "issuer", p.Issuer, "discovered", cfg.Issuer)
+	}
+	if cfg.AuthorizationEndpoint == "" || cfg.TokenEndpoint == "" || cfg.JWKSURI == "" {
+		return nil, errors.New("oidc discover: missing endpoint", "issuer", p.Issuer)
+	}
+
+	p.config = &cfg
+	return p.config, nil
+}
+
+func (p *Provider) do(req *http.Request, v any) error {
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "oidc request", "url", req.URL.String())
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.Wrap(err, "oidc request", "url", req.URL.String())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("oidc request: unexpected status", "url", req.URL.String(), "status", resp.StatusCode, "body", string(body))
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return errors.Wrap(err, "oidc request", "url", req.URL.String())
+	}
+	return nil
+}
+
+func (p *Provider) scopes() []string {
+	if len(p.Scopes) == 0 {
+		return []string{"openid", "email", "profile"}
+	}
+	return p.Scopes
+}
+
+// audience is either a string or an array of strings in the ID token.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(data, &multiple)
+	if err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// flexBool accepts "true" as well, because some providers send the booleans
+// as strings.
+type flexBool bool
+
+func (f *flexBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*f = true
+	default:
+		*f = false
+	}
+	return nil
+}
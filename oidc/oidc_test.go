@@ -0,0 +1,284 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/oidc/oidctest"
+)
+
+func newTestProvider(s *oidctest.Server) *Provider {
+	return &Provider{
+		Name:         "stub",
+		DisplayName:  "Stub",
+		Issuer:       s.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  oidctest.RedirectURL,
+		Client:       s.Client(),
+	}
+}
+
+// signIn runs the flow as the app and the browser do it together.
+func signIn(t *testing.T, s *oidctest.Server, p *Provider) (*Claims, error) {
+	t.Helper()
+	flow, err := NewFlow()
+	if err != nil {
+		t.Fatalf("new flow: %v", err)
+	}
+	authURL, err := p.AuthCodeURL(context.Background(), flow)
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+
+	callback := s.Authorize(t, authURL)
+	if callback.Get("state") != flow.State {
+		t.Fatalf("state = %q, want %q", callback.Get("state"), flow.State)
+	}
+	return p.Exchange(context.Background(), callback.Get("code"), flow)
+}
+
+func TestExchange(t *testing.T) {
+	for _, newKey := range []func(testing.TB, string) *oidctest.Key{oidctest.NewRSAKey, oidctest.NewECKey} {
+		key := newKey(t, "key-1")
+		t.Run(key.Alg(), func(t *testing.T) {
+			s := oidctest.NewServer(t, key)
+			var nonce string
+			s.IDToken = func(n string) string {
+				nonce = n
+				return key.Sign(t, s.Claims(n))
+			}
+
+			claims, err := signIn(t, s, newTestProvider(s))
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if claims.Subject != oidctest.Subject || claims.Email != oidctest.Email || !bool(claims.EmailVerified) {
+				t.Errorf("claims = %+v", claims)
+			}
+			if claims.Nonce == "" || claims.Nonce != nonce {
+				t.Errorf("nonce = %q, want %q", claims.Nonce, nonce)
+			}
+		})
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	s := oidctest.NewServer(t, oidctest.NewRSAKey(t, "key-1"))
+	p := newTestProvider(s)
+
+	flow, err := NewFlow()
+	if err != nil {
+		t.Fatalf("new flow: %v", err)
+	}
+	authURL, err := p.AuthCodeURL(context.Background(), flow)
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+	callback := s.Authorize(t, authURL)
+
+	// Note: the code is useless without the verifier, which never leaves the app.
+	flow.Verifier = "stolen-code-without-verifier"
+	_, err = p.Exchange(context.Background(), callback.Get("code"), flow)
+	if err == nil {
+		t.Fatal("exchange succeeded with a wrong verifier")
+	}
+}
+
+func TestExchangeInvalidToken(t *testing.T) {
+	rsaKey := oidctest.NewRSAKey(t, "rsa")
+	ecKey := oidctest.NewECKey(t, "ec")
+	forged := oidctest.NewRSAKey(t, "rsa")
+
+	tests := []struct {
+		name    string
+		idToken func(t *testing.T, s *oidctest.Server, nonce string) string
+	}{
+		{
+			name: "bad signature",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return forged.Sign(t, s.Claims(nonce))
+			},
+		},
+		{
+			name: "tampered payload",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				parts := strings.Split(rsaKey.Sign(t, s.Claims(nonce)), ".")
+				claims := s.Claims(nonce)
+				claims["sub"] = "somebody-else"
+				payload, err := json.Marshal(claims)
+				if err != nil {
+					t.Fatalf("marshal: %v", err)
+				}
+				parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+				return strings.Join(parts, ".")
+			},
+		},
+		{
+			name: "alg none",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				parts := strings.Split(rsaKey.SignWithHeader(t, map[string]any{"alg": "none", "kid": "rsa"}, s.Claims(nonce)), ".")
+				return parts[0] + "." + parts[1] + "."
+			},
+		},
+		{
+			name: "alg HS256",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return rsaKey.SignWithHeader(t, map[string]any{"alg": "HS256", "kid": "rsa"}, s.Claims(nonce))
+			},
+		},
+		{
+			name: "alg RS256 with ec key",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return ecKey.SignWithHeader(t, map[string]any{"alg": "RS256", "kid": "ec"}, s.Claims(nonce))
+			},
+		},
+		{
+			name: "alg ES256 with rsa key",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return rsaKey.SignWithHeader(t, map[string]any{"alg": "ES256", "kid": "rsa"}, s.Claims(nonce))
+			},
+		},
+		{
+			name: "unknown key ID",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return rsaKey.SignWithHeader(t, map[string]any{"alg": "RS256", "kid": "unknown"}, s.Claims(nonce))
+			},
+		},
+		{
+			name: "wrong issuer",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				claims := s.Claims(nonce)
+				claims["iss"] = "https://evil.example.com"
+				return rsaKey.Sign(t, claims)
+			},
+		},
+		{
+			name: "wrong audience",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				claims := s.Claims(nonce)
+				claims["aud"] = []string{"another-client"}
+				return rsaKey.Sign(t, claims)
+			},
+		},
+		{
+			name: "wrong nonce",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return rsaKey.Sign(t, s.Claims("replayed-nonce"))
+			},
+		},
+		{
+			name: "expired",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				claims := s.Claims(nonce)
+				claims["exp"] = time.Now().Add(-leeway - time.Minute).Unix()
+				return rsaKey.Sign(t, claims)
+			},
+		},
+		{
+			name: "no subject",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				claims := s.Claims(nonce)
+				delete(claims, "sub")
+				return rsaKey.Sign(t, claims)
+			},
+		},
+		{
+			name: "malformed",
+			idToken: func(t *testing.T, s *oidctest.Server, nonce string) string {
+				return "not-a-jwt"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := oidctest.NewServer(t, rsaKey, ecKey)
+			s.IDToken = func(nonce string) string {
+				return tt.idToken(t, s, nonce)
+			}
+
+			claims, err := signIn(t, s, newTestProvider(s))
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("exchange = %+v, %v, want %v", claims, err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestExchangeExpiredWithinLeeway(t *testing.T) {
+	key := oidctest.NewRSAKey(t, "key-1")
+	s := oidctest.NewServer(t, key)
+	s.IDToken = func(nonce string) string {
+		claims := s.Claims(nonce)
+		claims["exp"] = time.Now().Add(-leeway / 2).Unix()
+		return key.Sign(t, claims)
+	}
+
+	_, err := signIn(t, s, newTestProvider(s))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := oidctest.NewRSAKey(t, "old")
+	newKey := oidctest.NewRSAKey(t, "new")
+	s := oidctest.NewServer(t, oldKey)
+	p := newTestProvider(s)
+	signingKey := oldKey
+	s.IDToken = func(nonce string) string {
+		return signingKey.Sign(t, s.Claims(nonce))
+	}
+
+	_, err := signIn(t, s, p)
+	if err != nil {
+		t.Fatalf("exchange with the old key: %v", err)
+	}
+
+	s.SetKeys(newKey)
+	signingKey = newKey
+
+	// Note: the keys are not fetched again right away, so forged key IDs cannot flood the provider.
+	_, err = signIn(t, s, p)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("exchange right after the rotation = %v, want %v", err, ErrInvalidToken)
+	}
+	if s.KeyFetches() != 1 {
+		t.Fatalf("key fetches = %d, want 1", s.KeyFetches())
+	}
+
+	p.keys.fetchedAt = time.Now().Add(-minKeyRefresh)
+	_, err = signIn(t, s, p)
+	if err != nil {
+		t.Fatalf("exchange with the new key: %v", err)
+	}
+	if s.KeyFetches() != 2 {
+		t.Fatalf("key fetches = %d, want 2", s.KeyFetches())
+	}
+
+	signingKey = oldKey
+	_, err = signIn(t, s, p)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("exchange with the retired key = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	s := oidctest.NewServer(t, oidctest.NewRSAKey(t, "key-1"))
+	p := newTestProvider(s)
+	p.Issuer = s.URL + "/"
+
+	flow, err := NewFlow()
+	if err != nil {
+		t.Fatalf("new flow: %v", err)
+	}
+	_, err = p.AuthCodeURL(context.Background(), flow)
+	if err == nil {
+		t.Fatal("auth code url succeeded with another issuer")
+	}
+}
@@ -0,0 +1,320 @@
+// Package oidctest is a stub OpenID Connect provider for the tests of the
+// sign in by external accounts. It serves the discovery document, the keys,
+// the authorization and the token endpoints, and it checks PKCE as the real
+// providers do.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ClientID     = "client-id"
+	ClientSecret = "client-secret"
+	RedirectURL  = "http://app.test/oauth/stub/callback"
+	Subject      = "stub-subject"
+	Email        = "user@example.com"
+)
+
+// Key is a signing key of the provider.
+type Key struct {
+	ID     string
+	Signer crypto.Signer
+}
+
+// NewRSAKey generates a key for RS256.
+func NewRSAKey(t testing.TB, id string) *Key {
+	t.Helper()
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	return &Key{ID: id, Signer: signer}
+}
+
+// NewECKey generates a key for ES256.
+func NewECKey(t testing.TB, id string) *Key {
+	t.Helper()
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ec key: %v", err)
+	}
+	return &Key{ID: id, Signer: signer}
+}
+
+// Alg is the JWS algorithm of the key.
+func (k *Key) Alg() string {
+	if _, ok := k.Signer.(*ecdsa.PrivateKey); ok {
+		return "ES256"
+	}
+	return "RS256"
+}
+
+// Sign creates a compact JWS of the claims with the algorithm and the ID of
+// the key in the header.
+func (k *Key) Sign(t testing.TB, claims map[string]any) string {
+	t.Helper()
+	return k.SignWithHeader(t, map[string]any{"alg": k.Alg(), "kid": k.ID}, claims)
+}
+
+// SignWithHeader creates a compact JWS of the claims with the given header,
+// so the tests can lie about the algorithm or the key ID.
+func (k *Key) SignWithHeader(t testing.TB, header, claims map[string]any) string {
+	t.Helper()
+	token, err := k.sign(header, claims)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return token
+}
+
+func (k *Key) sign(header, claims map[string]any) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch signer := k.Signer.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, signer, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		return "", fmt.Errorf("unsupported key type %T", k.Signer)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (k *Key) jwk() map[string]string {
+	switch signer := k.Signer.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{
+			"kty": "RSA",
+			"kid": k.ID,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(signer.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(signer.E)).Bytes()),
+		}
+	case *ecdsa.PrivateKey:
+		return map[string]string{
+			"kty": "EC",
+			"kid": k.ID,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(signer.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(signer.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+	return nil
+}
+
+// Server is the stub provider. Its issuer is its URL.
+type Server struct {
+	*httptest.Server
+
+	// IDToken is issued for the code of the authorization request with the
+	// nonce. The valid claims are signed by the first key if it is nil.
+	IDToken func(nonce string) string
+
+	mu         sync.Mutex
+	keys       []*Key
+	requests   map[string]url.Values
+	codes      int
+	keyFetches int
+}
+
+// NewServer starts the provider with the published keys, it is closed at the
+// end of the test.
+func NewServer(t testing.TB, keys ...*Key) *Server {
+	s := &Server{
+		keys:     keys,
+		requests: make(map[string]url.Values),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /authorize", s.authorize)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("GET /keys", s.jwks)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetKeys replaces the published keys, e.g. to rotate them.
+func (s *Server) SetKeys(keys ...*Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+// KeyFetches is the number of the requests of the keys.
+func (s *Server) KeyFetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyFetches
+}
+
+// Claims are valid claims of an ID token with the nonce.
+func (s *Server) Claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            s.URL,
+		"sub":            Subject,
+		"aud":            ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          Email,
+		"email_verified": true,
+		"name":           "Stub User",
+	}
+}
+
+// Authorize follows the authorization URL as the browser would do, and
+// returns the query of the redirect back to the app, i.e. the code and the
+// state.
+func (s *Server) Authorize(t testing.TB, authURL string) url.Values {
+	t.Helper()
+	client := *s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	return location.Query()
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/keys",
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != ClientID ||
+		query.Get("redirect_uri") != RedirectURL || query.Get("code_challenge_method") != "S256" ||
+		query.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.codes++
+	code := "code-" + strconv.Itoa(s.codes)
+	s.requests[code] = query
+	s.mu.Unlock()
+
+	redirect := url.Values{
+		"code":  {code},
+		"state": {query.Get("state")},
+	}
+	http.Redirect(w, r, RedirectURL+"?"+redirect.Encode(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	request, ok := s.requests[r.FormValue("code")]
+	// Note: a code can be redeemed only once.
+	delete(s.requests, r.FormValue("code"))
+	s.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != RedirectURL ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != request.Get("code_challenge") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := request.Get("nonce")
+	var idToken string
+	if s.IDToken != nil {
+		idToken = s.IDToken(nonce)
+	} else {
+		s.mu.Lock()
+		key := s.keys[0]
+		s.mu.Unlock()
+
+		var err error
+		idToken, err = key.sign(map[string]any{"alg": key.Alg(), "kid": key.ID}, s.Claims(nonce))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyFetches++
+
+	keys := make([]map[string]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key.jwk())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,131 @@
+package password
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// The defaults follow the second recommended option of RFC 9106.
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024 // KiB
+	DefaultArgon2Threads = 4
+
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt, err := rand.Bytes(argon2SaltLen)
+	if err != nil {
+		return "", errors.Wrap(err, "argon2id hash")
+	}
+
+	params := a.params()
+	params.salt = salt
+	params.key = argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return params.encode(), nil
+}
+
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	stored, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	wanted := a.params()
+	return stored.time < wanted.time ||
+		stored.memory < wanted.memory ||
+		stored.threads < wanted.threads ||
+		len(stored.key) < argon2KeyLen
+}
+
+func (a *Argon2id) params() argon2Params {
+	params := argon2Params{
+		time:    a.Time,
+		memory:  a.Memory,
+		threads: a.Threads,
+	}
+	if params.time == 0 {
+		params.time = DefaultArgon2Time
+	}
+	if params.memory == 0 {
+		params.memory = DefaultArgon2Memory
+	}
+	if params.threads == 0 {
+		params.threads = DefaultArgon2Threads
+	}
+	return params
+}
+
+// encode uses the format of the reference implementation:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func (p *argon2Params) encode() string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(p.key))
+}
+
+func decodeArgon2id(encoded string) (*argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrInvalidEncoded
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, ErrInvalidEncoded
+	}
+
+	var params argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, ErrInvalidEncoded
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidEncoded
+	}
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return nil, ErrInvalidEncoded
+	}
+	return &params, nil
+}
+
+func compareArgon2id(encoded, password string) error {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return errors.Wrap(err, "argon2id compare")
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+	if subtle.ConstantTimeCompare(key, params.key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package password
+
+import (
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bcryptPrefix = "$2"
+
+type Bcrypt struct {
+	Cost int
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", errors.Wrap(err, "bcrypt hash")
+	}
+	return string(hashedBytes), nil
+}
+
+func (b *Bcrypt) NeedsRehash(encoded string) bool {
+	if !strings.HasPrefix(encoded, bcryptPrefix) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost < b.cost()
+}
+
+func (b *Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+func compareBcrypt(encoded, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return errors.Wrap(err, "bcrypt compare")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const breachedPrefixLen = 5
+
+// BreachedDir looks up the passwords in a local copy of the Pwned Passwords
+// range files. The file of a range is named by the first 5 hex characters of
+// the SHA-1 hash (with or without .txt extension), and every line of it is
+// "<remaining 35 hex characters>:<count>", the same as the k-anonymity API
+// responses.
+type BreachedDir struct {
+	Dir string
+}
+
+func (b *BreachedDir) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedPrefixLen], hash[breachedPrefixLen:]
+
+	file, err := b.open(prefix)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "breached password", "prefix", prefix)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return false, errors.Wrap(err, "breached password", "prefix", prefix)
+	}
+	return false, nil
+}
+
+func (b *BreachedDir) open(prefix string) (*os.File, error) {
+	file, err := os.Open(filepath.Join(b.Dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	}
+	return file, err
+}
@@ -0,0 +1,36 @@
+package password
+
+import (
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+var (
+	ErrMismatch       = errors.New("password does not match")
+	ErrUnknownHash    = errors.New("unknown password hash format")
+	ErrInvalidEncoded = errors.New("invalid encoded password hash")
+)
+
+type Hasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash tells whether the encoded hash was made by another algorithm
+	// or by weaker parameters than the ones of the Hasher.
+	NeedsRehash(encoded string) bool
+}
+
+// Compare detects the algorithm from the encoded hash, so it works with the
+// hashes of any Hasher.
+func Compare(encoded, password string) error {
+	switch {
+	case encoded == "":
+		// Note: the users signing in only by an external identity have no password.
+		return ErrMismatch
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return compareArgon2id(encoded, password)
+	case strings.HasPrefix(encoded, bcryptPrefix):
+		return compareBcrypt(encoded, password)
+	default:
+		return ErrUnknownHash
+	}
+}
@@ -0,0 +1,88 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	DefaultMinLength = 8
+	// minEmailPartLength is the shortest name of the email, which is looked for
+	// in the password, a shorter one would reject too many passwords.
+	minEmailPartLength = 3
+	// DefaultMaxLength is the limit of bcrypt, it ignores the bytes after it.
+	DefaultMaxLength = 72
+)
+
+var ErrPolicy = errors.New("password does not satisfy the policy")
+
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// Policy returns public errors, so they can be shown to the user as they
+// are.
+type Policy struct {
+	MinLength int
+	MaxLength int // bytes
+	Breached  BreachChecker
+}
+
+func (p *Policy) Validate(password, email string) error {
+	minLength := p.MinLength
+	if minLength == 0 {
+		minLength = DefaultMinLength
+	}
+	maxLength := p.MaxLength
+	if maxLength == 0 {
+		maxLength = DefaultMaxLength
+	}
+
+	if len([]rune(password)) < minLength {
+		return errors.Public(
+			errors.Wrap(ErrPolicy, "too short", "min length", minLength),
+			fmt.Sprintf("The password must be at least %d characters long.", minLength))
+	}
+	if len(password) > maxLength {
+		return errors.Public(
+			errors.Wrap(ErrPolicy, "too long", "max length", maxLength),
+			fmt.Sprintf("The password must not be longer than %d bytes.", maxLength))
+	}
+	if containsEmail(password, email) {
+		return errors.Public(
+			errors.Wrap(ErrPolicy, "contains email"),
+			"The password must not contain your email address.")
+	}
+
+	if p.Breached == nil {
+		return nil
+	}
+	breached, err := p.Breached.Breached(password)
+	if err != nil {
+		return errors.Wrap(err, "validate password")
+	}
+	if breached {
+		return errors.Public(
+			errors.Wrap(ErrPolicy, "breached"),
+			"This password has appeared in a data breach, so it is not safe to use. Please choose another one.")
+	}
+	return nil
+}
+
+// containsEmail tells whether the password contains the email address or its
+// part before the @, case insensitively.
+func containsEmail(password, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return false
+	}
+
+	name, _, _ := strings.Cut(email, "@")
+	if len(name) < minEmailPartLength {
+		return strings.Contains(password, email)
+	}
+	return strings.Contains(password, name)
+}
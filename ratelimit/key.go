@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/szykes/simple-backend/custctx"
+)
+
+type KeyFunc func(r *http.Request) string
+
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ByUser falls back to the IP address if nobody is signed in.
+func ByUser(r *http.Request) string {
+	user := custctx.User(r.Context())
+	if user == nil {
+		return ByIP(r)
+	}
+	return "user:" + strconv.Itoa(user.ID)
+}
+
+// ByRoute shares the limit between everybody calling the same route. The
+// route pattern is only complete after the routing, so the limiter should be
+// added by chi.Router.With to the route itself.
+func ByRoute(r *http.Request) string {
+	pattern := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		pattern = rctx.RoutePattern()
+	}
+	if pattern == "" {
+		pattern = r.URL.Path
+	}
+	return "route:" + r.Method + " " + pattern
+}
+
+func Combine(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		key := ""
+		for i, k := range keys {
+			if i != 0 {
+				key += "|"
+			}
+			key += k(r)
+		}
+		return key
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const memorySweepInterval = 10 * time.Minute
+
+// MemoryStore is enough for a single instance. Every instance has its own
+// buckets, so use PostgresStore if there are more of them.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	limit Limit
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{
+			bucket: newBucket(limit, now),
+			limit:  limit,
+		}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+	return b.take(limit, now), nil
+}
+
+// sweep forgets the full buckets, they are the same as the new ones.
+func (m *MemoryStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if b.full(b.limit, now) {
+			delete(m.buckets, key)
+		}
+	}
+}
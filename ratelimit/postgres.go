@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// PostgresStore shares the buckets between the instances of the web app.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (p *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "postgres take", "key", key)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	initial := newBucket(limit, now)
+	_, err = tx.ExecContext(ctx, `
+    INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+    VALUES ($1, $2, $3) ON CONFLICT (key) DO NOTHING;`,
+		key, initial.tokens, initial.updatedAt)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "postgres take", "key", key)
+	}
+
+	var b bucket
+	row := tx.QueryRowContext(ctx, `
+    SELECT tokens, updated_at
+    FROM rate_limit_buckets
+    WHERE key = $1
+    FOR UPDATE;`,
+		key)
+	err = row.Scan(&b.tokens, &b.updatedAt)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "postgres take", "key", key)
+	}
+
+	result := b.take(limit, now)
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE rate_limit_buckets
+    SET tokens = $2, updated_at = $3
+    WHERE key = $1;`,
+		key, b.tokens, b.updatedAt)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "postgres take", "key", key)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Result{}, errors.Wrap(err, "postgres take", "key", key)
+	}
+	return result, nil
+}
+
+// DeleteIdle removes the buckets which were not used for a while. They are
+// refilled by then anyway, if olderThan is longer than any limit's period.
+func (p *PostgresStore) DeleteIdle(ctx context.Context, olderThan time.Duration) error {
+	_, err := p.DB.ExecContext(ctx, `
+    DELETE FROM rate_limit_buckets
+    WHERE updated_at < $1;`,
+		time.Now().Add(-olderThan))
+	if err != nil {
+		return errors.Wrap(err, "postgres delete idle")
+	}
+	return nil
+}
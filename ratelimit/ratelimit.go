@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// Limit describes a token bucket: it holds Burst tokens at most and it is
+// refilled by Requests tokens in every Per duration.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type Limiter struct {
+	Name  string
+	Store Store
+	Limit Limit
+	Key   KeyFunc
+	// Reject writes the response of the limited requests. It is plain text
+	// 429 by default.
+	Reject http.HandlerFunc
+}
+
+func (l *Limiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.Name + ":" + l.Key(r)
+		result, err := l.Store.Take(r.Context(), key, l.Limit)
+		if err != nil {
+			// Note: failing open, an unavailable store should not take the site down.
+			log.Printf("ERROR: rate limit: %v\n", errors.Wrap(err, "take token", "key", key).Error())
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.Limit.burst()))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			if l.Reject != nil {
+				l.Reject(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return max(l.Requests, 1)
+}
+
+// rate is the refilled tokens per second.
+func (l Limit) rate() float64 {
+	if l.Per <= 0 {
+		return 0
+	}
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newBucket(limit Limit, now time.Time) bucket {
+	return bucket{
+		tokens:    float64(limit.burst()),
+		updatedAt: now,
+	}
+}
+
+func (b *bucket) take(limit Limit, now time.Time) Result {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = min(float64(limit.burst()), b.tokens+elapsed*limit.rate())
+		b.updatedAt = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{
+			Allowed:   true,
+			Remaining: int(b.tokens),
+		}
+	}
+
+	result := Result{
+		RetryAfter: time.Duration(math.MaxInt64),
+	}
+	if rate := limit.rate(); rate > 0 {
+		result.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+func (b *bucket) full(limit Limit, now time.Time) bool {
+	return b.tokens+now.Sub(b.updatedAt).Seconds()*limit.rate() >= float64(limit.burst())
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// Local keeps the objects as files under Dir, the key is the relative path.
+// Get returns an *os.File, so the callers can seek in it.
+type Local struct {
+	Dir string
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+
+	// Note: the file is written aside, and moved into place only when it is complete.
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".put-*")
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return errors.Wrap(err, "put local object", "key", key)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get local object", "key", key)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, errors.Wrap(localError(err), "get local object", "key", key)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "get local object", "key", key)
+	}
+	return f, localObject(key, info), nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return errors.Wrap(err, "delete local object", "key", key)
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Wrap(err, "delete local object", "key", key)
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Object, error) {
+	// Note: only the dir of the prefix is walked, not the whole tree.
+	root := l.dir()
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = filepath.Join(root, filepath.FromSlash(prefix[:i]))
+	}
+
+	var objects []Object
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.dir(), name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *localObject(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list local objects", "prefix", prefix)
+	}
+	return objects, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*Object, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat local object", "key", key)
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, errors.Wrap(localError(err), "stat local object", "key", key)
+	}
+	return localObject(key, info), nil
+}
+
+func (l *Local) dir() string {
+	if l.Dir == "" {
+		return DefaultLocalDir
+	}
+	return l.Dir
+}
+
+// path refuses the keys, which would point out of the dir.
+func (l *Local) path(key string) (string, error) {
+	if key == "" || path.Clean("/"+key) != "/"+key {
+		return "", errors.New("invalid key")
+	}
+	return filepath.Join(l.dir(), filepath.FromSlash(key)), nil
+}
+
+func localObject(key string, info fs.FileInfo) *Object {
+	return &Object{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     info.ModTime(),
+	}
+}
+
+func localError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	return err
+}
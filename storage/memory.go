@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// Memory keeps the objects in the memory. It is meant for the development
+// and the tests, everything is lost at exit.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	Object
+	data []byte
+}
+
+// memoryReader can seek like the files of Local.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (m *Memory) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "put memory object", "key", key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.objects == nil {
+		m.objects = make(map[string]memoryObject)
+	}
+	m.objects[key] = memoryObject{
+		Object: Object{
+			Key:         key,
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			ModTime:     time.Now(),
+		},
+		data: data,
+	}
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, nil, errors.Wrap(ErrNotExist, "get memory object", "key", key)
+	}
+	return memoryReader{bytes.NewReader(object.data)}, &object.Object, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix string) ([]Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var objects []Object
+	for key, object := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object.Object)
+		}
+	}
+	slices.SortFunc(objects, func(a, b Object) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return objects, nil
+}
+
+func (m *Memory) Stat(ctx context.Context, key string) (*Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, errors.Wrap(ErrNotExist, "stat memory object", "key", key)
+	}
+	return &object.Object, nil
+}
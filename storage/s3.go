@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat   = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3 keeps the objects in a bucket of an S3 compatible service, e.g. AWS S3
+// or MinIO. The requests are signed by AWS Signature Version 4, but the
+// payload is not, so the uploads are streamed.
+type S3 struct {
+	// Endpoint is the base URL of the service, e.g.
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket into the path instead of the host, MinIO
+	// needs it usually.
+	PathStyle bool
+	Client    *http.Client
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, r)
+	if err != nil {
+		return errors.Wrap(err, "put s3 object", "key", key)
+	}
+	// Note: a body of unknown length would be sent chunked, which S3 refuses.
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrap(err, "put s3 object", "key", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get s3 object", "key", key)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get s3 object", "key", key)
+	}
+	return resp.Body, s3Object(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "delete s3 object", "key", key)
+	}
+
+	resp, err := s.do(req)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return errors.Wrap(err, "delete s3 object", "key", key)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "list s3 objects", "prefix", prefix)
+		}
+
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "list s3 objects", "prefix", prefix)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "list s3 objects", "prefix", prefix)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, Object{
+				Key:     content.Key,
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*Object, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat s3 object", "key", key)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat s3 object", "key", key)
+	}
+	resp.Body.Close()
+	return s3Object(key, resp), nil
+}
+
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "new s3 request")
+	}
+
+	u := url.URL{
+		Scheme:   endpoint.Scheme,
+		Host:     s.Bucket + "." + endpoint.Host,
+		Path:     strings.TrimSuffix(endpoint.Path, "/") + "/" + key,
+		RawQuery: s3Query(query),
+	}
+	if s.PathStyle {
+		u.Host = endpoint.Host
+		u.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket + "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "new s3 request")
+	}
+	return req, nil
+}
+
+// do signs and sends the request. The error responses are turned into
+// errors, ErrNotExist if the object or the key does not exist.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "do s3 request")
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err s3Error
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Err)
+	// Note: HEAD responses have no body, so only the status is known.
+	if resp.StatusCode == http.StatusNotFound && (s3Err.Code == "NoSuchKey" || req.Method == http.MethodHead) {
+		return nil, errors.Wrap(ErrNotExist, "do s3 request")
+	}
+	return nil, errors.New("s3 error response", "status", resp.StatusCode, "code", s3Err.Code, "message", s3Err.Message)
+}
+
+// sign adds the Authorization header by AWS Signature Version 4.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3AmzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	credential, signedHeaders, signature := s.signature(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, s3UnsignedPayload, now)
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+credential+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *S3) signature(method, path, query string, headers map[string]string, payloadHash string, now time.Time) (string, string, string) {
+	amzDate := now.Format(s3AmzDateFormat)
+	date := amzDate[:8]
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.SecretAccessKey), date)
+	key = s3HMAC(key, s.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return s.AccessKeyID + "/" + scope, signedHeaders, hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3Object(key string, resp *http.Response) *Object {
+	object := Object{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		object.Size = size
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		object.ModTime = modTime
+	}
+	return &object
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query is sorted by the keys, and it is escaped in the way of the
+// signature, so it can be used in the canonical request as it is.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3EscapeComponent(key)+"="+s3EscapeComponent(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes everything, except the unreserved characters and the
+// slashes.
+func s3Escape(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = s3EscapeComponent(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3EscapeComponent(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes a stored object. The keys are slash separated paths, e.g.
+// "gallery-1/photo.jpg".
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Storage keeps the objects by their keys. Put replaces the object of the key
+// as a whole, nobody sees a half written one. Delete does not fail, if the
+// object does not exist.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Stat(ctx context.Context, key string) (*Object, error)
+}
+
+const (
+	BackendLocal  = "local"
+	BackendS3     = "s3"
+	BackendMemory = "memory"
+
+	// DefaultLocalDir is absolute, so the files do not depend on the working
+	// directory, and it is the volume of the container.
+	DefaultLocalDir = "/images"
+)
+
+// Config selects the storage by Backend, the settings of the other backends
+// are ignored.
+type Config struct {
+	Backend string
+	Local   Local
+	S3      S3
+}
+
+func New(cfg Config) (Storage, error) {
+	switch cfg.Backend {
+	case BackendLocal, "":
+		return &cfg.Local, nil
+	case BackendS3:
+		return &cfg.S3, nil
+	case BackendMemory:
+		return &Memory{}, nil
+	default:
+		return nil, errors.New("unknown storage backend", "backend", cfg.Backend)
+	}
+}
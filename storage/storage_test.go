@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/szykes/simple-backend/errors"
+)
+
+// testStorage checks the contract of Storage, which every backend must keep.
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	put := func(t *testing.T, key, content, contentType string) {
+		t.Helper()
+		err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), contentType)
+		if err != nil {
+			t.Fatalf("put %v: %v", key, err)
+		}
+	}
+	get := func(t *testing.T, key string) (string, *Object) {
+		t.Helper()
+		r, object, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("get %v: %v", key, err)
+		}
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %v: %v", key, err)
+		}
+		return string(content), object
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		put(t, "gallery-1/photo.jpg", "jpeg content", "image/jpeg")
+
+		content, object := get(t, "gallery-1/photo.jpg")
+		if content != "jpeg content" {
+			t.Errorf("content = %q, want %q", content, "jpeg content")
+		}
+		if object.Key != "gallery-1/photo.jpg" || object.Size != int64(len(content)) || object.ContentType != "image/jpeg" {
+			t.Errorf("object = %+v", object)
+		}
+		if object.ModTime.IsZero() {
+			t.Error("no modification time")
+		}
+
+		stat, err := s.Stat(ctx, "gallery-1/photo.jpg")
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if stat.Key != object.Key || stat.Size != object.Size || stat.ContentType != object.ContentType {
+			t.Errorf("stat = %+v, want %+v", stat, object)
+		}
+	})
+
+	t.Run("put replaces", func(t *testing.T) {
+		put(t, "gallery-2/photo.png", "old", "image/png")
+		put(t, "gallery-2/photo.png", "the new content", "image/png")
+
+		content, object := get(t, "gallery-2/photo.png")
+		if content != "the new content" || object.Size != int64(len(content)) {
+			t.Errorf("content = %q, size = %d", content, object.Size)
+		}
+	})
+
+	t.Run("special characters", func(t *testing.T) {
+		key := "gallery-3/summer (1) + sea & sun ~100%.jpg"
+		put(t, key, "escaped", "image/jpeg")
+
+		content, object := get(t, key)
+		if content != "escaped" || object.Key != key {
+			t.Errorf("content = %q, key = %q", content, object.Key)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := s.Get(ctx, "gallery-1/missing.jpg")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("get = %v, want %v", err, ErrNotExist)
+		}
+		_, err = s.Stat(ctx, "gallery-1/missing.jpg")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("stat = %v, want %v", err, ErrNotExist)
+		}
+		err = s.Delete(ctx, "gallery-1/missing.jpg")
+		if err != nil {
+			t.Errorf("delete = %v, want nil", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		put(t, "gallery-4/photo.jpg", "to be deleted", "image/jpeg")
+
+		err := s.Delete(ctx, "gallery-4/photo.jpg")
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		_, err = s.Stat(ctx, "gallery-4/photo.jpg")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("stat after delete = %v, want %v", err, ErrNotExist)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		for _, key := range []string{
+			"gallery-5/b.jpg",
+			"gallery-5/a.jpg",
+			"gallery-5/renditions/thumbnail/a.jpg",
+			"gallery-5/c.jpg",
+			"gallery-50/a.jpg",
+			"gallery-6/a.jpg",
+		} {
+			put(t, key, key, "image/jpeg")
+		}
+
+		objects, err := s.List(ctx, "gallery-5/")
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		keys := make([]string, 0, len(objects))
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+			if object.Size != int64(len(object.Key)) {
+				t.Errorf("size of %v = %d, want %d", object.Key, object.Size, len(object.Key))
+			}
+		}
+		slices.Sort(keys)
+		want := []string{"gallery-5/a.jpg", "gallery-5/b.jpg", "gallery-5/c.jpg", "gallery-5/renditions/thumbnail/a.jpg"}
+		if !slices.Equal(keys, want) {
+			t.Errorf("keys = %v, want %v", keys, want)
+		}
+
+		objects, err = s.List(ctx, "gallery-7/")
+		if err != nil || len(objects) != 0 {
+			t.Errorf("list of nothing = %v, %v", objects, err)
+		}
+	})
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, &Local{Dir: t.TempDir()})
+}
+
+func TestLocalInvalidKey(t *testing.T) {
+	dir := t.TempDir()
+	l := &Local{Dir: filepath.Join(dir, "images")}
+	for _, key := range []string{"", "../outside.jpg", "gallery-1/../../outside.jpg", "/absolute.jpg", "gallery-1//a.jpg"} {
+		err := l.Put(context.Background(), key, strings.NewReader("x"), 1, "image/jpeg")
+		if err == nil {
+			t.Errorf("put %q succeeded", key)
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, "outside.jpg"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file is written out of the dir: %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, &Memory{})
+}
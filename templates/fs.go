@@ -2,5 +2,5 @@ package templates
 
 import "embed"
 
-//go:embed *.html
+//go:embed *.html email/*.html email/*.txt
 var FS embed.FS
@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/szykes/simple-backend/errors"
+	"github.com/szykes/simple-backend/rand"
+)
+
+// The parameters are the defaults of RFC 6238, because the authenticator apps
+// support these ones the best.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	secretSize = 20
+	skewSteps  = 1
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid TOTP code")
+
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func NewSecret() (string, error) {
+	b, err := rand.Bytes(secretSize)
+	if err != nil {
+		return "", errors.Wrap(err, "new TOTP secret")
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(Digits)},
+		"period":    {strconv.Itoa(int(Period.Seconds()))},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errors.Wrap(err, "TOTP code")
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for range Digits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%modulo), nil
+}
+
+// Validate accepts the codes of the neighbouring time steps as well, because
+// the clocks are never in sync. It returns the matching time step, so the
+// caller can reject the reuse of the same code.
+func Validate(secret, code string, t time.Time) (int64, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, ErrInvalidCode
+	}
+
+	current := Step(t)
+	for step := current - skewSteps; step <= current+skewSteps; step++ {
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, errors.Wrap(err, "validate TOTP code")
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
@@ -32,6 +32,9 @@ func MustParseFS(fs fs.FS, patterns ...string) *Template {
 		"user": func() (template.HTML, error) {
 			return "", fmt.Errorf("not implemented")
 		},
+		"impersonator": func() (template.HTML, error) {
+			return "", fmt.Errorf("not implemented")
+		},
 		"errors": func() (template.HTML, error) {
 			return "", fmt.Errorf("not implemented")
 		},
@@ -60,6 +63,9 @@ func (t *Template) Execute(w http.ResponseWriter, r *http.Request, data any, err
 		"user": func() *models.User {
 			return custctx.User(r.Context())
 		},
+		"impersonator": func() *models.User {
+			return custctx.Impersonator(r.Context())
+		},
 		"errors": func() []string {
 			var errMsgs []string
 			for _, err := range errs {